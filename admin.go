@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdminHandler serves the admin API, on its own listener
+type AdminHandler struct {
+	Handler *RequestHandler
+	Token   string      // expected as bearer token, if set
+	Config  interface{} // effective configuration, fields tagged with redact:"true" are hidden
+
+	mux *http.ServeMux
+}
+
+func NewAdminHandler(handler *RequestHandler, token string, config interface{}) *AdminHandler {
+	a := &AdminHandler{
+		Handler: handler,
+		Token:   token,
+		Config:  config,
+		mux:     http.NewServeMux(),
+	}
+
+	a.mux.HandleFunc("/routes", a.serveRoutes)
+	a.mux.HandleFunc("/reload", a.serveReload)
+	a.mux.HandleFunc("/status", a.serveStatus)
+	a.mux.HandleFunc("/pool", a.servePool)
+	a.mux.HandleFunc("/requests", a.serveRequests)
+	a.mux.HandleFunc("/verbose", a.serveVerbose)
+	a.mux.HandleFunc("/config", a.serveConfig)
+
+	return a
+}
+
+func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.Token != "" {
+		token := ""
+		if parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2); len(parts) == 2 && parts[0] == "Bearer" {
+			token = parts[1]
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pgasus admin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Invalid admin token."))
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	a.mux.ServeHTTP(w, r)
+}
+
+// lists loaded routes, with types of their parameters
+func (a *AdminHandler) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	routes, _ := a.Handler.routes.Load().([]*Route)
+
+	response := make([]map[string]interface{}, 0, len(routes))
+	for _, route := range routes {
+		parameters := make(map[string]string, len(route.ParametersTypes))
+		for name, typ := range route.ParametersTypes {
+			parameters[name] = typ.Name
+		}
+
+		response = append(response, map[string]interface{}{
+			"route_id":         route.RouteID,
+			"method":           route.Method,
+			"url_path":         route.UrlPath,
+			"object_type":      route.ObjectType,
+			"object_name":      route.ObjectName,
+			"parameters":       parameters,
+			"selected_columns": route.SelectedColumns,
+			"ttl":              route.TTL,
+			"is_public":        route.IsPublic,
+		})
+	}
+
+	writeAdminJson(w, http.StatusOK, response)
+}
+
+// reloads routes, and returns the result
+func (a *AdminHandler) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := http.StatusOK
+	if err := a.Handler.createHandlers(); err != nil {
+		status = http.StatusInternalServerError
+	}
+
+	writeAdminJson(w, status, a.Handler.lastReload())
+}
+
+// returns the state of the listener and the result of the last reload, kept out of the public readiness probe
+func (a *AdminHandler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	listener := a.Handler.listenerState()
+
+	writeAdminJson(w, http.StatusOK, map[string]interface{}{
+		"maintenance_mode":   a.Handler.maintenanceState().Mode,
+		"listener_connected": listener.Connected,
+		"listener_since":     listener.Since,
+		"listener_error":     listener.LastError,
+		"last_reload":        a.Handler.lastReload(),
+	})
+}
+
+// returns statistics of the connection pool
+func (a *AdminHandler) servePool(w http.ResponseWriter, r *http.Request) {
+	stat := a.Handler.db.Stat()
+
+	writeAdminJson(w, http.StatusOK, map[string]interface{}{
+		"acquire_count":          stat.AcquireCount(),
+		"acquire_duration_secs":  stat.AcquireDuration().Seconds(),
+		"acquired_conns":         stat.AcquiredConns(),
+		"canceled_acquire_count": stat.CanceledAcquireCount(),
+		"constructing_conns":     stat.ConstructingConns(),
+		"empty_acquire_count":    stat.EmptyAcquireCount(),
+		"idle_conns":             stat.IdleConns(),
+		"max_conns":              stat.MaxConns(),
+		"total_conns":            stat.TotalConns(),
+	})
+}
+
+// lists requests being processed
+func (a *AdminHandler) serveRequests(w http.ResponseWriter, r *http.Request) {
+	writeAdminJson(w, http.StatusOK, a.Handler.inflight.List())
+}
+
+// returns verbosity, or changes it with POST /verbose?enabled=true
+func (a *AdminHandler) serveVerbose(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Boolean enabled argument expected."))
+			return
+		}
+
+		a.Handler.setVerbose(enabled)
+	}
+
+	writeAdminJson(w, http.StatusOK, map[string]bool{"enabled": a.Handler.isVerbose()})
+}
+
+// returns the effective configuration, without secrets
+func (a *AdminHandler) serveConfig(w http.ResponseWriter, r *http.Request) {
+	writeAdminJson(w, http.StatusOK, redactConfig(reflect.ValueOf(a.Config)))
+}
+
+func writeAdminJson(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// converts configuration to generic values, replacing non-empty fields tagged with redact:"true"
+func redactConfig(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return redactConfig(v.Elem())
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+
+			if field.Tag.Get("redact") == "true" && !v.Field(i).IsZero() {
+				m[field.Name] = "REDACTED"
+			} else {
+				m[field.Name] = redactConfig(v.Field(i))
+			}
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		s := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s = append(s, redactConfig(v.Index(i)))
+		}
+		return s
+	default:
+		return v.Interface()
+	}
+}
+
+// InflightRequests keeps track of requests being processed
+type InflightRequests struct {
+	mutex    sync.Mutex
+	lastID   int64
+	requests map[int64]*InflightRequest
+}
+
+type InflightRequest struct {
+	ID         int64     `json:"id"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	RemoteAddr string    `json:"remote_addr"`
+	Started    time.Time `json:"started"`
+}
+
+func NewInflightRequests() *InflightRequests {
+	return &InflightRequests{
+		requests: make(map[int64]*InflightRequest),
+	}
+}
+
+func (t *InflightRequests) Begin(r *http.Request) int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.lastID++
+	id := t.lastID
+
+	t.requests[id] = &InflightRequest{
+		ID:         id,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		Started:    time.Now(),
+	}
+
+	return id
+}
+
+func (t *InflightRequests) End(id int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.requests, id)
+}
+
+// returns requests being processed, oldest first
+func (t *InflightRequests) List() []*InflightRequest {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	list := make([]*InflightRequest, 0, len(t.requests))
+	for _, request := range t.requests {
+		list = append(list, request)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return list
+}
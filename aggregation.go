@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	queryme "github.com/debackerl/queryme/go"
+)
+
+// aggregate functions available to clients, count_distinct is count(DISTINCT column)
+var aggregateFunctions = map[string]struct{}{
+	"count":          {},
+	"count_distinct": {},
+	"sum":            {},
+	"avg":            {},
+	"min":            {},
+	"max":            {},
+}
+
+// types of columns accepted by sum and avg
+var summableTypes = map[string]struct{}{
+	"smallint":         {},
+	"integer":          {},
+	"bigint":           {},
+	"real":             {},
+	"double precision": {},
+	"numeric":          {},
+	"money":            {},
+	"interval":         {},
+}
+
+// types of columns accepted by date_trunc buckets
+var truncatableTypes = map[string]struct{}{
+	"date":                        {},
+	"timestamp without time zone": {},
+	"timestamp with time zone":    {},
+}
+
+// units of date_trunc buckets
+var bucketUnits = map[string]struct{}{
+	"minute":  {},
+	"hour":    {},
+	"day":     {},
+	"week":    {},
+	"month":   {},
+	"quarter": {},
+	"year":    {},
+}
+
+// AggregateTerm is an output column of an aggregation, a group or an aggregate
+type AggregateTerm struct {
+	Alias    string
+	Function string // aggregate function, or date_trunc unit of groups, empty for plain groups
+	Column   string // empty for count()
+}
+
+// Aggregation groups records of a relation
+type Aggregation struct {
+	Groups     []*AggregateTerm
+	Aggregates []*AggregateTerm
+	aliases    map[string]struct{}
+}
+
+// reads groups and aggregates from the query string, nil if not requested
+// e.g. group=status,month:month(created_at)&aggregate=n:count(),total:sum(amount)
+func parseAggregation(r *http.Request, groupQueryName string, aggregateQueryName string, route *Route) (*Aggregation, error) {
+	query := r.URL.Query()
+
+	rawGroups := ""
+	if groupQueryName != "" {
+		rawGroups = query.Get(groupQueryName)
+	}
+	rawAggregates := ""
+	if aggregateQueryName != "" {
+		rawAggregates = query.Get(aggregateQueryName)
+	}
+
+	if rawGroups == "" && rawAggregates == "" {
+		return nil, nil
+	}
+
+	if !route.Aggregation {
+		return nil, &HttpError{Status: http.StatusBadRequest, Err: errors.New("Aggregation unsupported on this route.")}
+	}
+
+	aggregation := &Aggregation{
+		aliases: make(map[string]struct{}),
+	}
+
+	if rawGroups != "" {
+		for _, item := range strings.Split(rawGroups, ",") {
+			term, err := parseAggregateTerm(item)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := checkAggregateColumn(route, term.Column); err != nil {
+				return nil, err
+			}
+
+			if term.Function != "" {
+				if _, ok := bucketUnits[term.Function]; !ok {
+					return nil, aggregationError("Unknown bucket " + term.Function + ".")
+				}
+				if _, ok := truncatableTypes[route.ParametersTypes[term.Column].Name]; !ok {
+					return nil, aggregationError("Column " + term.Column + " can't be bucketed.")
+				}
+			}
+
+			if term.Alias == "" {
+				term.Alias = term.Column
+			}
+
+			if err := aggregation.addAlias(term.Alias); err != nil {
+				return nil, err
+			}
+			aggregation.Groups = append(aggregation.Groups, term)
+		}
+	}
+
+	if rawAggregates != "" {
+		for _, item := range strings.Split(rawAggregates, ",") {
+			term, err := parseAggregateTerm(item)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := aggregateFunctions[term.Function]; !ok {
+				return nil, aggregationError("Unknown aggregate " + term.Function + ".")
+			}
+
+			if term.Column == "" {
+				if term.Function != "count" {
+					return nil, aggregationError("Column expected in " + term.Function + ".")
+				}
+			} else if err := checkAggregateColumn(route, term.Column); err != nil {
+				return nil, err
+			}
+
+			if term.Function == "sum" || term.Function == "avg" {
+				if _, ok := summableTypes[route.ParametersTypes[term.Column].Name]; !ok {
+					return nil, aggregationError("Column " + term.Column + " can't be summed.")
+				}
+			}
+
+			if term.Alias == "" {
+				term.Alias = term.Function
+				if term.Column != "" {
+					term.Alias += "_" + term.Column
+				}
+			}
+
+			if err := aggregation.addAlias(term.Alias); err != nil {
+				return nil, err
+			}
+			aggregation.Aggregates = append(aggregation.Aggregates, term)
+		}
+	}
+
+	return aggregation, nil
+}
+
+// parses [alias:]column or [alias:]function(column)
+func parseAggregateTerm(item string) (*AggregateTerm, error) {
+	term := &AggregateTerm{}
+
+	expr := strings.TrimSpace(item)
+	if i := strings.IndexRune(expr, ':'); i >= 0 {
+		term.Alias = strings.TrimSpace(expr[:i])
+		expr = strings.TrimSpace(expr[i+1:])
+	}
+
+	if i := strings.IndexRune(expr, '('); i >= 0 {
+		if !strings.HasSuffix(expr, ")") {
+			return nil, aggregationError("Invalid aggregation " + item + ".")
+		}
+		term.Function = strings.TrimSpace(expr[:i])
+		term.Column = strings.TrimSpace(expr[i+1 : len(expr)-1])
+	} else {
+		term.Column = expr
+	}
+
+	if term.Function == "" && term.Column == "" {
+		return nil, aggregationError("Invalid aggregation " + item + ".")
+	}
+
+	return term, nil
+}
+
+func checkAggregateColumn(route *Route, column string) error {
+	_, ok := route.ParametersTypes[column]
+	if _, hidden := route.HiddenFields[column]; !ok || hidden {
+		return aggregationError("Unknown column " + column + ".")
+	}
+	return nil
+}
+
+func (a *Aggregation) addAlias(alias string) error {
+	if _, ok := a.aliases[alias]; ok {
+		return aggregationError("Duplicate column " + alias + ".")
+	}
+	a.aliases[alias] = struct{}{}
+	return nil
+}
+
+// sort orders can only refer to output columns of the aggregation
+func (a *Aggregation) checkOrder(order []*queryme.SortOrder) error {
+	for _, o := range order {
+		if _, ok := a.aliases[string(o.Field)]; !ok {
+			return aggregationError("Unknown column " + string(o.Field) + " in sort order.")
+		}
+	}
+	return nil
+}
+
+func aggregationError(message string) error {
+	return &HttpError{Status: http.StatusBadRequest, Err: errors.New(message)}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseAggregateTerm(t *testing.T) {
+	tests := []struct {
+		item string
+		term *AggregateTerm // nil if the term must be refused
+	}{
+		{"status", &AggregateTerm{Column: "status"}},
+		{" status ", &AggregateTerm{Column: "status"}},
+		{"s:status", &AggregateTerm{Alias: "s", Column: "status"}},
+		{"month(created_at)", &AggregateTerm{Function: "month", Column: "created_at"}},
+		{"m : month( created_at )", &AggregateTerm{Alias: "m", Function: "month", Column: "created_at"}},
+		{"count()", &AggregateTerm{Function: "count"}},
+		{"n:count()", &AggregateTerm{Alias: "n", Function: "count"}},
+		{"total:sum(amount)", &AggregateTerm{Alias: "total", Function: "sum", Column: "amount"}},
+		{"sum(amount", nil},
+		{"", nil},
+		{"n:", nil},
+	}
+
+	for _, test := range tests {
+		term, err := parseAggregateTerm(test.item)
+
+		if test.term == nil {
+			if err == nil {
+				t.Errorf("%q: term %+v accepted", test.item, term)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.item, err)
+		} else if *term != *test.term {
+			t.Errorf("%q: %+v expected, got %+v", test.item, test.term, term)
+		}
+	}
+}
+
+func TestParseAggregation(t *testing.T) {
+	route := &Route{
+		Aggregation: true,
+		ParametersTypes: map[string]ArgumentType{
+			"status":     {Name: "text"},
+			"amount":     {Name: "numeric"},
+			"created_at": {Name: "timestamp with time zone"},
+			"secret":     {Name: "text"},
+		},
+		HiddenFields: map[string]struct{}{"secret": {}},
+	}
+
+	tests := []struct {
+		name      string
+		group     string
+		aggregate string
+		valid     bool
+	}{
+		{"groups and aggregates", "status,month:month(created_at)", "n:count(),total:sum(amount)", true},
+		{"default aliases", "status", "count(),sum(amount)", true},
+		{"count distinct", "", "count_distinct(status)", true},
+		{"unknown bucket", "second(created_at)", "", false},
+		{"bucket of text", "month(status)", "", false},
+		{"unknown aggregate", "", "median(amount)", false},
+		{"sum of text", "", "sum(status)", false},
+		{"column expected", "", "sum()", false},
+		{"hidden column", "secret", "", false},
+		{"unknown column", "", "max(other)", false},
+		{"duplicate alias", "status", "status:max(amount)", false},
+	}
+
+	for _, test := range tests {
+		query := url.Values{}
+		if test.group != "" {
+			query.Set("group", test.group)
+		}
+		if test.aggregate != "" {
+			query.Set("aggregate", test.aggregate)
+		}
+		r := httptest.NewRequest("GET", "/?"+query.Encode(), nil)
+
+		_, err := parseAggregation(r, "group", "aggregate", route)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: valid %v expected, got error %v", test.name, test.valid, err)
+		}
+	}
+}
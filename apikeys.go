@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/naoina/denco"
+)
+
+// delay between updates of last_used_at columns
+const apiKeysUsageFlushInterval = 10 * time.Second
+
+// ApiKey is read from the API keys table, keys themselves are only known by their SHA-256 hash
+type ApiKey struct {
+	KeyID     string
+	Role      string
+	ExpiresAt time.Time // zero if the key never expires
+	Scopes    []string
+	Routes    map[int]struct{} // IDs of routes allowed, all routes if empty
+}
+
+// returns cached API keys by hash, nil until loaded
+func (h *RequestHandler) apiKeys() map[[sha256.Size]byte]*ApiKey {
+	keys, _ := h.apiKeysByHash.Load().(map[[sha256.Size]byte]*ApiKey)
+	return keys
+}
+
+// reads all API keys from their table, the previous keys are kept on errors
+func (h *RequestHandler) loadApiKeys(ctx context.Context, tx pgx.Tx) error {
+	if h.ApiKeysTableName == "" {
+		return nil
+	}
+
+	rows, err := tx.Query(ctx, `SELECT key_id,key_hash,role,expires_at,scopes,route_ids FROM `+quoteIdentifier(h.ApiKeysTableName))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	keys := make(map[[sha256.Size]byte]*ApiKey)
+
+	for rows.Next() {
+		var hash []byte
+		var expiresAt pgtype.Timestamptz
+		var routeIDs []int32
+		key := &ApiKey{
+			Routes: make(map[int]struct{}),
+		}
+
+		if err := rows.Scan(&key.KeyID, &hash, &key.Role, &expiresAt, &key.Scopes, &routeIDs); err != nil {
+			return err
+		}
+
+		if len(hash) != sha256.Size {
+			log.Printf("API key %q ignored, SHA-256 hash expected.", key.KeyID)
+			continue
+		}
+
+		if expiresAt.Status == pgtype.Present {
+			key.ExpiresAt = expiresAt.Time
+		}
+		for _, id := range routeIDs {
+			key.Routes[int(id)] = struct{}{}
+		}
+
+		var k [sha256.Size]byte
+		copy(k[:], hash)
+		keys[k] = key
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	h.apiKeysByHash.Store(keys)
+
+	return nil
+}
+
+// reloads API keys in their own transaction
+func (h *RequestHandler) reloadApiKeys() error {
+	ctx := context.Background()
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	return h.loadApiKeys(ctx, tx)
+}
+
+// returns the API key sent by the client in the configured header or query parameter, if any
+func (h *RequestHandler) requestApiKey(r *http.Request) string {
+	if h.ApiKeysHeaderName != "" {
+		if key := r.Header.Get(h.ApiKeysHeaderName); key != "" {
+			return key
+		}
+	}
+
+	if h.ApiKeysQueryParameter != "" {
+		return r.URL.Query().Get(h.ApiKeysQueryParameter)
+	}
+
+	return ""
+}
+
+// authenticates API keys, the identity is attached to the returned request
+// invalid keys are answered with a 401 status code, and a nil request is returned
+func (h *RequestHandler) authenticateApiKey(w http.ResponseWriter, r *http.Request) *http.Request {
+	secret := h.requestApiKey(r)
+	if secret == "" {
+		return r
+	}
+
+	identity, err := h.verifyApiKey(r, secret)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return nil
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), tokenIdentityKey{}, identity))
+}
+
+func (h *RequestHandler) verifyApiKey(r *http.Request, secret string) (*TokenIdentity, error) {
+	if r.TLS == nil {
+		return nil, errors.New("Authorization denied over unencrypted connections.")
+	}
+
+	key, ok := h.apiKeys()[sha256.Sum256([]byte(secret))]
+	if !ok {
+		return nil, errors.New("Invalid API key.")
+	}
+
+	if !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt) {
+		return nil, errors.New("API key expired.")
+	}
+
+	h.apiKeysUsage.Touch(key.KeyID)
+
+	identity := &TokenIdentity{
+		Role:    key.Role,
+		Context: make(map[string]string),
+		Routes:  key.Routes,
+		Scopes:  key.Scopes,
+	}
+
+	if h.ApiKeysKeyIDVariable != "" {
+		identity.Context[h.ApiKeysKeyIDVariable] = key.KeyID
+	}
+	if h.ApiKeysScopesVariable != "" {
+		scopes := key.Scopes
+		if scopes == nil {
+			scopes = []string{}
+		}
+		raw, _ := json.Marshal(scopes)
+		identity.Context[h.ApiKeysScopesVariable] = string(raw)
+	}
+
+	return identity, nil
+}
+
+// makes a request handler answering 403 if the client's API key is restricted to other routes
+func (h *RequestHandler) makeApiKeyRoutesHandler(route *Route, next denco.HandlerFunc) denco.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		if identity := requestTokenIdentity(r); identity != nil && len(identity.Routes) > 0 {
+			if _, ok := identity.Routes[route.RouteID]; !ok {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("API key not allowed on this route."))
+				return
+			}
+		}
+
+		next(w, r, params)
+	}
+}
+
+// ApiKeysUsage collects keys used since the last flush, so that requests don't wait for updates of their table
+type ApiKeysUsage struct {
+	mutex sync.Mutex
+	used  map[string]time.Time
+}
+
+func NewApiKeysUsage() *ApiKeysUsage {
+	return &ApiKeysUsage{
+		used: make(map[string]time.Time),
+	}
+}
+
+func (u *ApiKeysUsage) Touch(keyID string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.used[keyID] = time.Now()
+}
+
+// returns keys used since the last call, with their last use
+func (u *ApiKeysUsage) take() map[string]time.Time {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	used := u.used
+	u.used = make(map[string]time.Time)
+	return used
+}
+
+// periodically updates last_used_at of API keys used since the previous update
+func (h *RequestHandler) recordApiKeysUsage() {
+	go func() {
+		ticker := time.NewTicker(apiKeysUsageFlushInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			used := h.apiKeysUsage.take()
+			if len(used) == 0 {
+				continue
+			}
+
+			if err := h.updateApiKeysUsage(used); err != nil {
+				log.Println("Cannot update usage of API keys:", err)
+			}
+		}
+	}()
+}
+
+func (h *RequestHandler) updateApiKeysUsage(used map[string]time.Time) error {
+	ctx := context.Background()
+
+	keyIDs := make([]string, 0, len(used))
+	lastUses := make([]time.Time, 0, len(used))
+	for keyID, lastUse := range used {
+		keyIDs = append(keyIDs, keyID)
+		lastUses = append(lastUses, lastUse)
+	}
+
+	// the channel is not notified by this update, see the trigger in pgasus.sql
+	sql := fmt.Sprintf(`UPDATE %s AS k SET last_used_at=u.last_used_at FROM unnest($1::text[], $2::timestamptz[]) AS u(key_id, last_used_at) WHERE k.key_id=u.key_id`, quoteIdentifier(h.ApiKeysTableName))
+
+	_, err := h.db.Exec(ctx, sql, keyIDs, lastUses)
+	return err
+}
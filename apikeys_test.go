@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVerifyApiKey(t *testing.T) {
+	// keys are stored as digest(key, 'sha256'), e.g. for 'abc'
+	abcHash := sha256.Sum256([]byte("abc"))
+	if fmt.Sprintf("%x", abcHash) != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Fatal("SHA-256 hash expected")
+	}
+
+	h := &RequestHandler{
+		ApiKeysKeyIDVariable:  "key_id",
+		ApiKeysScopesVariable: "scopes",
+		apiKeysUsage:          NewApiKeysUsage(),
+	}
+	h.apiKeysByHash.Store(map[[sha256.Size]byte]*ApiKey{
+		abcHash:                        {KeyID: "k1", Role: "partner", Scopes: []string{"read"}},
+		sha256.Sum256([]byte("old")):   {KeyID: "k2", Role: "partner", ExpiresAt: time.Now().Add(-time.Hour)},
+		sha256.Sum256([]byte("later")): {KeyID: "k3", Role: "partner", ExpiresAt: time.Now().Add(time.Hour)},
+	})
+
+	tests := []struct {
+		name   string
+		secret string
+		tls    bool
+		keyID  string // empty if the key must be refused
+		scopes string
+	}{
+		{"valid", "abc", true, "k1", `["read"]`},
+		{"not expired yet", "later", true, "k3", `[]`},
+		{"expired", "old", true, "", ""},
+		{"unknown", "abd", true, "", ""},
+		{"prefix of a key", "ab", true, "", ""},
+		{"unencrypted", "abc", false, "", ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+
+		identity, err := h.verifyApiKey(r, test.secret)
+
+		if test.keyID == "" {
+			if err == nil {
+				t.Errorf("%s: key accepted", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if identity.Role != "partner" || identity.Context["key_id"] != test.keyID || identity.Context["scopes"] != test.scopes {
+			t.Errorf("%s: unexpected identity %+v", test.name, identity)
+		}
+	}
+}
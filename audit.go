@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// AuditEntry records who changed what through the API
+type AuditEntry struct {
+	Time         time.Time                `json:"time"`
+	RouteID      int                      `json:"route_id"`
+	Method       string                   `json:"method"`
+	Role         string                   `json:"role"`
+	ClientIP     string                   `json:"client_ip"`
+	RequestID    string                   `json:"request_id,omitempty"`
+	Filter       string                   `json:"filter,omitempty"`
+	Body         []map[string]interface{} `json:"body,omitempty"` // arguments of each query, with redacted fields
+	RowsAffected *int64                   `json:"rows_affected"`  // unknown for procedures and reads
+}
+
+// AuditFile writes audit entries as JSON lines
+type AuditFile struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func OpenAuditFile(path string) (*AuditFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditFile{file: file}, nil
+}
+
+func (f *AuditFile) Write(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, err = f.file.Write(append(line, '\n'))
+	return err
+}
+
+// returns the audit entry of the request, nil if not audited
+// POST, PUT, and DELETE routes are audited, and GET routes opting in
+func (h *RequestHandler) newAuditEntry(route *Route, r *http.Request, role string, queries []map[string]interface{}) *AuditEntry {
+	if h.AuditTableName == "" && h.auditFile == nil {
+		return nil
+	}
+	if route.Method == "get" && !route.AuditReads {
+		return nil
+	}
+
+	entry := &AuditEntry{
+		Time:     time.Now(),
+		RouteID:  route.RouteID,
+		Method:   route.Method,
+		Role:     role,
+		ClientIP: h.clientIP(r),
+	}
+
+	if h.AuditRequestIDHeader != "" {
+		entry.RequestID = r.Header.Get(h.AuditRequestIDHeader)
+	}
+	if h.FilterQueryName != "" {
+		entry.Filter = r.URL.Query().Get(h.FilterQueryName)
+	}
+
+	for _, query := range queries {
+		body := make(map[string]interface{}, len(query))
+		for name, value := range query {
+			if _, ok := route.AuditRedactedFields[name]; ok {
+				body[name] = "REDACTED"
+			} else {
+				body[name] = auditValue(value)
+			}
+		}
+		entry.Body = append(entry.Body, body)
+	}
+
+	return entry
+}
+
+// returns the IP address of the client, as reported by X-Forwarded-For when connected through trusted proxies
+// addresses are read from the right, and the first one not of a trusted proxy is the client's
+func (h *RequestHandler) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	if len(h.auditTrustedProxies) == 0 {
+		return ip
+	}
+
+	var forwarded []string
+	for _, values := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(values, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(addr))
+		}
+	}
+
+	// the address of the peer has been appended already
+	if h.UpdateForwardedForHeader && len(forwarded) > 0 {
+		forwarded = forwarded[:len(forwarded)-1]
+	}
+
+	for i := len(forwarded) - 1; i >= 0 && h.isTrustedProxy(ip); i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			break
+		}
+		ip = forwarded[i]
+	}
+
+	return ip
+}
+
+func (h *RequestHandler) isTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, network := range h.auditTrustedProxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parses trusted proxies, as IP addresses or CIDR networks
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// pgtype values without JSON encoding are converted to their database value
+func auditValue(value interface{}) interface{} {
+	if _, ok := value.(json.Marshaler); ok {
+		return value
+	}
+
+	if valuer, ok := value.(driver.Valuer); ok {
+		if v, err := valuer.Value(); err == nil {
+			return v
+		}
+	}
+
+	return value
+}
+
+func (entry *AuditEntry) setRowsAffected(n int64) {
+	if entry != nil {
+		entry.RowsAffected = &n
+	}
+}
+
+// inserts the entry into the audit table, in the request's transaction, after the route's query
+// the role of the client is reset during the insert, so that clients don't need privileges on the audit table
+func (h *RequestHandler) auditInTx(ctx context.Context, tx pgx.Tx, entry *AuditEntry) error {
+	if entry == nil || h.AuditTableName == "" {
+		return nil
+	}
+
+	if _, err := tx.Exec(ctx, "RESET ROLE"); err != nil {
+		return err
+	}
+
+	if err := h.insertAuditEntry(ctx, tx, entry); err != nil {
+		return err
+	}
+
+	// later statements of the transaction must not run with the privileges of the server's role
+	if entry.Role != "" {
+		if _, err := tx.Exec(ctx, "SET LOCAL ROLE E"+quoteWith(entry.Role, '\'', true)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *RequestHandler) insertAuditEntry(ctx context.Context, tx pgx.Tx, entry *AuditEntry) error {
+
+	body, err := json.Marshal(entry.Body)
+	if err != nil {
+		return err
+	}
+
+	sql := NewSqlBuilder()
+	sql.WriteSql("INSERT INTO ")
+	sql.WriteId(h.AuditTableName)
+	sql.WriteSql(" (time,route_id,method,role,client_ip,request_id,filter,body,rows_affected) VALUES (")
+	sql.WriteValue(entry.Time)
+	sql.WriteSql(",")
+	sql.WriteValue(entry.RouteID)
+	sql.WriteSql(",")
+	sql.WriteValue(entry.Method)
+	sql.WriteSql(",")
+	sql.WriteValue(entry.Role)
+	sql.WriteSql(",")
+	sql.WriteValue(entry.ClientIP)
+	sql.WriteSql(",")
+	sql.WriteValue(entry.RequestID)
+	sql.WriteSql(",")
+	sql.WriteValue(entry.Filter)
+	sql.WriteSql(",")
+	sql.WriteValue(string(body))
+	sql.WriteSql(",")
+	sql.WriteValue(entry.RowsAffected)
+	sql.WriteSql(")")
+
+	if _, err := tx.Exec(ctx, sql.Sql(), sql.Values()...); err != nil {
+		log.Println("While executing:", sql.Sql())
+		return err
+	}
+
+	return nil
+}
+
+// writes the entry to the audit file, once the transaction is committed
+func (h *RequestHandler) auditAfterCommit(entry *AuditEntry) {
+	if entry == nil || h.auditFile == nil {
+		return
+	}
+
+	if err := h.auditFile.Write(entry); err != nil {
+		log.Println("Cannot write audit entry:", err)
+	}
+}
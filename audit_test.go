@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		proxies    bool
+		updated    bool
+		remoteAddr string
+		forwarded  string
+		ip         string
+	}{
+		{"direct", true, false, "198.51.100.7:1234", "", "198.51.100.7"},
+		{"untrusted peer", true, false, "198.51.100.7:1234", "203.0.113.5", "198.51.100.7"},
+		{"no trusted proxies", false, false, "10.0.0.1:1234", "203.0.113.5", "10.0.0.1"},
+		{"trusted proxy", true, false, "10.0.0.1:1234", "203.0.113.5", "203.0.113.5"},
+		{"trusted proxy address", true, false, "192.0.2.1:1234", "203.0.113.5", "203.0.113.5"},
+		{"trusted ipv6 proxy", true, false, "[2001:db8::1]:1234", "203.0.113.5", "203.0.113.5"},
+		{"chain of proxies", true, false, "10.0.0.1:1234", "203.0.113.5, 10.0.0.2", "203.0.113.5"},
+		{"spoofed by client", true, false, "10.0.0.1:1234", "1.1.1.1, 203.0.113.5", "203.0.113.5"},
+		{"header updated", true, true, "10.0.0.1:1234", "203.0.113.5, 10.0.0.1", "203.0.113.5"},
+		{"invalid address", true, false, "10.0.0.1:1234", "unknown", "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		h := &RequestHandler{UpdateForwardedForHeader: test.updated}
+		if test.proxies {
+			h.auditTrustedProxies = proxies
+		}
+
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if ip := h.clientIP(r); ip != test.ip {
+			t.Errorf("%s: %s expected, got %s", test.name, test.ip, ip)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid network accepted")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/naoina/denco"
+)
+
+// makes a request handler checking allowed roles and required scopes of the route, before any query of the route
+// anonymous clients are answered with a 401 status code, others with a 403 status code
+func (h *RequestHandler) makeAuthorizationHandler(route *Route, next denco.HandlerFunc) denco.HandlerFunc {
+	allowedRoles := make(map[string]struct{}, len(route.AllowedRoles))
+	for _, role := range route.AllowedRoles {
+		allowedRoles[role] = struct{}{}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		identity := requestTokenIdentity(r)
+
+		if len(allowedRoles) > 0 {
+			role, err := h.requestRole(r)
+			if err == errUnencryptedAuthorization || err == errIncorrectCredentials {
+				w.Header().Set("Cache-Control", "no-store")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(err.Error()))
+				return
+			} else if err != nil {
+				panic(err)
+			}
+
+			if _, ok := allowedRoles[role]; !ok {
+				writeAuthorizationFailure(w, identity == nil && role == h.DefaultCn, "Role not allowed on this route.")
+				return
+			}
+		}
+
+		if len(route.RequiredScopes) > 0 {
+			if identity == nil {
+				writeAuthorizationFailure(w, true, "Scopes required on this route.")
+				return
+			}
+
+			for _, scope := range route.RequiredScopes {
+				if !identity.HasScope(scope) {
+					writeAuthorizationFailure(w, false, "Scope "+scope+" required on this route.")
+					return
+				}
+			}
+		}
+
+		next(w, r, params)
+	}
+}
+
+// returns true if the role, scopes, and routes of API keys of the client satisfy the route, e.g. for embedded resources
+func isRouteAuthorized(route *Route, role string, identity *TokenIdentity) bool {
+	if identity != nil && len(identity.Routes) > 0 {
+		if _, ok := identity.Routes[route.RouteID]; !ok {
+			return false
+		}
+	}
+
+	if len(route.AllowedRoles) > 0 {
+		allowed := false
+		for _, allowedRole := range route.AllowedRoles {
+			if allowedRole == role {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	for _, scope := range route.RequiredScopes {
+		if identity == nil || !identity.HasScope(scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// returns the role of the client, without a transaction
+// only passwords of basic authentication are checked against the database
+func (h *RequestHandler) requestRole(r *http.Request) (string, error) {
+	return getClientRole(r.Context(), h.db, r, h.DefaultCn)
+}
+
+func writeAuthorizationFailure(w http.ResponseWriter, anonymous bool, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+	if anonymous {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Authentication required."))
+	} else {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(message))
+	}
+}
+
+// returns scopes of the scope claim, space-separated, or of the scp claim, an array
+func jwtScopes(claims map[string]interface{}) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+
+	var scopes []string
+	if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, s := range scp {
+			if scope, ok := s.(string); ok {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	return scopes
+}
@@ -4,15 +4,27 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"mime"
 	"net/http"
 	"strconv"
 	"time"
 )
 
+// columns of a record returned as a file, only content is required
+const (
+	FileContentColumn     = "content"
+	FileContentTypeColumn = "content_type"
+	FileFilenameColumn    = "filename"
+)
+
 type BinRecordSetWriter struct {
 	bytes.Buffer
 	MaxResponseSizeBytes int64
 	ContentType          string
+	Filename             string
+
+	inFile bool   // true while visiting a record describing a file
+	column string // column of the file being visited
 }
 
 func (w *BinRecordSetWriter) ToBytes() []byte {
@@ -21,6 +33,10 @@ func (w *BinRecordSetWriter) ToBytes() []byte {
 
 func (w *BinRecordSetWriter) HttpRespond(hw http.ResponseWriter) {
 	hw.Header().Set("Content-Type", w.ContentType)
+	hw.Header().Set("Content-Length", strconv.Itoa(w.Len()))
+	if w.Filename != "" {
+		hw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": w.Filename}))
+	}
 	hw.WriteHeader(http.StatusOK)
 	hw.Write(w.ToBytes())
 }
@@ -41,8 +57,20 @@ func (w *BinRecordSetWriter) EndRecordSet(rs *RecordSet) error {
 	return nil
 }
 
+// a single record is accepted if it describes a file, with a content column
 func (w *BinRecordSetWriter) BeginRecord(rs *RecordSet) error {
-	return errors.New("Record sets not supported by binary format.")
+	if w.inFile || w.Len() > 0 {
+		return errors.New("Binary format may contain only one file.")
+	}
+
+	for i := range rs.Columns {
+		if string(rs.Columns[i].Name) == FileContentColumn {
+			w.inFile = true
+			return nil
+		}
+	}
+
+	return errors.New("Records not supported by binary format, unless they have a " + FileContentColumn + " column.")
 }
 
 func (w *BinRecordSetWriter) EndRecord(rs *RecordSet) error {
@@ -50,14 +78,25 @@ func (w *BinRecordSetWriter) EndRecord(rs *RecordSet) error {
 }
 
 func (w *BinRecordSetWriter) BeginColumn(rs *RecordSet) error {
-	return errors.New("Record sets not supported by binary format.")
+	if !w.inFile {
+		return errors.New("Record sets not supported by binary format.")
+	}
+
+	_, field := rs.CurrentColumn()
+	w.column = string(field.Name)
+
+	return nil
 }
 
 func (w *BinRecordSetWriter) EndColumn(rs *RecordSet) error {
+	w.column = ""
 	return nil
 }
 
 func (w *BinRecordSetWriter) BeginArray(rs *RecordSet, size int) error {
+	if w.inFile && w.column != FileContentColumn {
+		return nil
+	}
 	return errors.New("Arrays not supported by binary format.")
 }
 
@@ -66,6 +105,9 @@ func (w *BinRecordSetWriter) EndArray(rs *RecordSet) error {
 }
 
 func (w *BinRecordSetWriter) BeginObject(rs *RecordSet) error {
+	if w.inFile && w.column != FileContentColumn {
+		return nil
+	}
 	return errors.New("Objects not supported by binary format.")
 }
 
@@ -106,6 +148,21 @@ func (w *BinRecordSetWriter) DateTime(rs *RecordSet, v time.Time) error {
 }
 
 func (w *BinRecordSetWriter) String(rs *RecordSet, v string) error {
+	if w.inFile {
+		switch w.column {
+		case FileContentTypeColumn:
+			w.ContentType = v
+			return nil
+		case FileFilenameColumn:
+			w.Filename = v
+			return nil
+		case FileContentColumn:
+		default:
+			// other columns are ignored
+			return nil
+		}
+	}
+
 	if w.Len() > 0 {
 		return errors.New("Binary format may contain only one scalar value.")
 	}
@@ -116,6 +173,10 @@ func (w *BinRecordSetWriter) String(rs *RecordSet, v string) error {
 }
 
 func (w *BinRecordSetWriter) Bytes(rs *RecordSet, v []byte) error {
+	if w.inFile && w.column != FileContentColumn {
+		return nil
+	}
+
 	if w.Len() > 0 {
 		return errors.New("Binary format may contain only one scalar value.")
 	}
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
+
+	"github.com/jackc/pgconn"
 )
 
+// HttpError can be panicked by handlers to answer with a status code other than 500
+type HttpError struct {
+	Status int
+	Err    error
+}
+
+func (e *HttpError) Error() string {
+	return e.Err.Error()
+}
+
 type catchingHandler struct {
 	next http.Handler
 }
@@ -16,16 +29,33 @@ func CatchingHandler(h http.Handler) http.Handler {
 func (h catchingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer func() {
 		if r := recover(); r != nil {
+			if httpErr, ok := r.(*HttpError); ok {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(httpErr.Status)
+				w.Write([]byte(httpErr.Error()))
+				return
+			}
+
 			log.Println("Error while processing request:", r)
 
 			w.WriteHeader(http.StatusInternalServerError)
 
 			if err, ok := r.(error); ok {
 				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				w.Write([]byte(err.Error()))
+				w.Write([]byte(clientErrorMessage(err)))
 			}
 		}
 	}()
 
 	h.next.ServeHTTP(w, req)
 }
+
+// returns the message of an error reported to clients, database errors are limited to their primary message
+func clientErrorMessage(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Message
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// attributes of client certificates usable as identity
+const (
+	CertIdentityCn          = "cn"
+	CertIdentityOu          = "ou"
+	CertIdentitySanEmail    = "san_email"
+	CertIdentitySanDns      = "san_dns"
+	CertIdentitySanUri      = "san_uri"
+	CertIdentitySerial      = "serial"
+	CertIdentityFingerprint = "fingerprint"
+)
+
+// checks the identity set in the configuration
+func checkCertificateIdentity(attribute string) error {
+	switch attribute {
+	case "", CertIdentityCn, CertIdentityOu, CertIdentitySanEmail, CertIdentitySanDns, CertIdentitySanUri, CertIdentitySerial, CertIdentityFingerprint:
+		return nil
+	}
+
+	return fmt.Errorf("Unknown certificate identity %q.", attribute)
+}
+
+// returns the configured attribute of the certificate, empty if missing
+func certificateIdentity(cert *x509.Certificate, attribute string) (string, error) {
+	switch attribute {
+	case "", CertIdentityCn:
+		return cert.Subject.CommonName, nil
+	case CertIdentityOu:
+		if len(cert.Subject.OrganizationalUnit) > 0 {
+			return cert.Subject.OrganizationalUnit[0], nil
+		}
+	case CertIdentitySanEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0], nil
+		}
+	case CertIdentitySanDns:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0], nil
+		}
+	case CertIdentitySanUri:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String(), nil
+		}
+	case CertIdentitySerial:
+		return cert.SerialNumber.String(), nil
+	case CertIdentityFingerprint:
+		return certificateFingerprint(cert), nil
+	default:
+		return "", fmt.Errorf("Unknown certificate identity %q.", attribute)
+	}
+
+	return "", nil
+}
+
+// returns the SHA-256 fingerprint of the certificate, in lowercase hexadecimal
+func certificateFingerprint(cert *x509.Certificate) string {
+	return fmt.Sprintf("%x", sha256.Sum256(cert.Raw))
+}
+
+// returns roles by certificate identity, nil if not loaded
+func (h *RequestHandler) certificateRoles() map[string]string {
+	roles, _ := h.certRoles.Load().(map[string]string)
+	return roles
+}
+
+// reads the table mapping certificate identities to roles
+func (h *RequestHandler) loadCertificateRoles(ctx context.Context, tx pgx.Tx) error {
+	if h.ClientCertRolesTableName == "" {
+		return nil
+	}
+
+	rows, err := tx.Query(ctx, `SELECT identity,role FROM `+quoteIdentifier(h.ClientCertRolesTableName))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	roles := make(map[string]string)
+
+	for rows.Next() {
+		var identity, role string
+		if err := rows.Scan(&identity, &role); err != nil {
+			return err
+		}
+		roles[identity] = role
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	h.certRoles.Store(roles)
+
+	return nil
+}
+
+// maps client certificates to a role, and context variables, the identity is attached to the returned request
+// unknown certificates are answered with a 401 status code, and a nil request is returned
+func (h *RequestHandler) authenticateCertificate(w http.ResponseWriter, r *http.Request) *http.Request {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return r
+	}
+
+	identity, err := h.verifyCertificate(r.TLS.PeerCertificates[0])
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return nil
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), tokenIdentityKey{}, identity))
+}
+
+func (h *RequestHandler) verifyCertificate(cert *x509.Certificate) (*TokenIdentity, error) {
+	role, err := certificateIdentity(cert, h.ClientCertIdentity)
+	if err != nil {
+		return nil, err
+	}
+	if role == "" {
+		return nil, errors.New("Client certificate without identity.")
+	}
+
+	if h.ClientCertRolesTableName != "" {
+		mapped, ok := h.certificateRoles()[role]
+		if !ok {
+			return nil, errors.New("Unknown client certificate.")
+		}
+		role = mapped
+	}
+
+	identity := &TokenIdentity{
+		Role:    role,
+		Context: make(map[string]string),
+	}
+
+	if h.ClientCertSubjectVariable != "" {
+		identity.Context[h.ClientCertSubjectVariable] = cert.Subject.String()
+	}
+	if h.ClientCertFingerprintVariable != "" {
+		identity.Context[h.ClientCertFingerprintVariable] = certificateFingerprint(cert)
+	}
+
+	return identity, nil
+}
+
+// CrlChecker rejects revoked client certificates during TLS handshakes
+// revocation lists are read from a PEM or DER file, re-read periodically
+type CrlChecker struct {
+	Path       string
+	ReloadSecs int
+
+	mutex  sync.Mutex
+	crls   []*x509.RevocationList
+	loaded time.Time
+}
+
+// can be used as VerifyPeerCertificate of tls.Config, chains were verified already
+func (c *CrlChecker) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	crls, err := c.revocationLists()
+	if err != nil {
+		return err
+	}
+
+	for _, chain := range verifiedChains {
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+
+			for _, crl := range crls {
+				if crl.CheckSignatureFrom(issuer) != nil {
+					continue // issued by another CA
+				}
+
+				for _, revoked := range crl.RevokedCertificateEntries {
+					if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+						return fmt.Errorf("Certificate %s of %q revoked.", cert.SerialNumber, cert.Subject.String())
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *CrlChecker) revocationLists() ([]*x509.RevocationList, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.crls == nil || (c.ReloadSecs > 0 && time.Since(c.loaded) > time.Duration(c.ReloadSecs)*time.Second) {
+		crls, err := loadCrls(c.Path)
+		if err != nil {
+			// previous lists remain valid if the file can't be read
+			log.Println("Cannot load CRL file:", err)
+			if c.crls == nil {
+				return nil, errors.New("No revocation list to check certificates.")
+			}
+		} else {
+			c.crls = crls
+		}
+		c.loaded = time.Now()
+	}
+
+	return c.crls, nil
+}
+
+// reads all revocation lists of a PEM file, or a single DER encoded list
+func loadCrls(path string) ([]*x509.RevocationList, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	crls := make([]*x509.RevocationList, 0, 1)
+
+	rest := raw
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+
+	if len(crls) == 0 {
+		crl, err := x509.ParseRevocationList(raw)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+
+	return crls, nil
+}
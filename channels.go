@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/naoina/denco"
+)
+
+// ChannelHub multiplexes notifications received on the single listening connection to all subscribers
+type ChannelHub struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[*ChannelSubscriber]struct{}
+	listened    map[string]struct{} // channels on which the listening connection currently listens
+	reserved    map[string]struct{} // channels listened to by pgasus itself
+	dirty       bool                // true when subscriptions changed since last sync
+	wake        context.CancelFunc
+	filtering   chan *filteredNotification // notifications waiting for procedures of subscribers
+}
+
+type ChannelSubscriber struct {
+	Channel       string
+	Notifications chan *pgconn.Notification
+	Filter        *ChannelFilter // nil if all payloads are sent
+}
+
+// ChannelFilter is the procedure checking each payload sent to a subscriber, in its role and context
+type ChannelFilter struct {
+	Procedure string
+	Role      string
+	Context   map[string]string
+}
+
+type filteredNotification struct {
+	notification *pgconn.Notification
+	subscribers  []*ChannelSubscriber
+}
+
+func NewChannelHub() *ChannelHub {
+	return &ChannelHub{
+		subscribers: make(map[string]map[*ChannelSubscriber]struct{}),
+		listened:    make(map[string]struct{}),
+		reserved:    make(map[string]struct{}),
+		filtering:   make(chan *filteredNotification, 256),
+	}
+}
+
+// keeps given channel listened to, even without subscribers
+func (hub *ChannelHub) Reserve(channel string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.reserved[channel] = struct{}{}
+}
+
+func (hub *ChannelHub) Subscribe(channel string, filter *ChannelFilter) *ChannelSubscriber {
+	s := &ChannelSubscriber{
+		Channel:       channel,
+		Notifications: make(chan *pgconn.Notification, 16),
+		Filter:        filter,
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	subscribers, ok := hub.subscribers[channel]
+	if !ok {
+		subscribers = make(map[*ChannelSubscriber]struct{})
+		hub.subscribers[channel] = subscribers
+	}
+	subscribers[s] = struct{}{}
+
+	hub.wakeUp()
+
+	return s
+}
+
+func (hub *ChannelHub) Unsubscribe(s *ChannelSubscriber) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.remove(s)
+}
+
+// forwards a notification to subscribers of its channel, slow subscribers are dropped
+// notifications to subscribers with a filter are queued, so that the listening connection isn't blocked
+func (hub *ChannelHub) Dispatch(notification *pgconn.Notification) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	var filtered []*ChannelSubscriber
+
+	for s := range hub.subscribers[notification.Channel] {
+		if s.Filter != nil {
+			filtered = append(filtered, s)
+		} else {
+			hub.send(s, notification)
+		}
+	}
+
+	if len(filtered) > 0 {
+		select {
+		case hub.filtering <- &filteredNotification{notification: notification, subscribers: filtered}:
+		default:
+			log.Println("Too many notifications to filter, subscribers dropped from channel", notification.Channel)
+			for _, s := range filtered {
+				hub.remove(s)
+			}
+		}
+	}
+}
+
+// forwards queued notifications to subscribers whose procedure accepted them, in order
+// check is called once per notification, for all subscribers with a filter
+func (hub *ChannelHub) FilterNotifications(check func(payload string, subscribers []*ChannelSubscriber) ([]bool, error)) {
+	for item := range hub.filtering {
+		granted, err := check(item.notification.Payload, item.subscribers)
+		if err != nil {
+			log.Println("Error while filtering notification:", err)
+		}
+
+		hub.mutex.Lock()
+		for i, s := range item.subscribers {
+			if _, ok := hub.subscribers[s.Channel][s]; !ok {
+				// unsubscribed meanwhile
+				continue
+			}
+
+			if err != nil {
+				// the client will reconnect
+				hub.remove(s)
+			} else if granted[i] {
+				hub.send(s, item.notification)
+			}
+		}
+		hub.mutex.Unlock()
+	}
+}
+
+// forgets channels listened to, must be called when the listening connection is replaced
+func (hub *ChannelHub) Reset() {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.listened = make(map[string]struct{})
+}
+
+// issues LISTEN and UNLISTEN commands on given connection to match current subscriptions
+func (hub *ChannelHub) Sync(ctx context.Context, conn *pgx.Conn) error {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.dirty = false
+
+	for channel := range hub.reserved {
+		if err := hub.listen(ctx, conn, channel); err != nil {
+			return err
+		}
+	}
+
+	for channel := range hub.subscribers {
+		if err := hub.listen(ctx, conn, channel); err != nil {
+			return err
+		}
+	}
+
+	for channel := range hub.listened {
+		_, isReserved := hub.reserved[channel]
+		_, isSubscribed := hub.subscribers[channel]
+
+		if !isReserved && !isSubscribed {
+			channelId := pgx.Identifier{channel}
+			if _, err := conn.Exec(ctx, fmt.Sprintf("unlisten %s", channelId.Sanitize())); err != nil {
+				return err
+			}
+
+			delete(hub.listened, channel)
+		}
+	}
+
+	return nil
+}
+
+// makes a context to wait for notifications, cancelled when subscriptions change
+func (hub *ChannelHub) WaitContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	waitContext, cancel := context.WithTimeout(ctx, timeout)
+	hub.wake = cancel
+
+	if hub.dirty {
+		// subscriptions changed after last sync
+		cancel()
+	}
+
+	return waitContext, cancel
+}
+
+func (hub *ChannelHub) listen(ctx context.Context, conn *pgx.Conn, channel string) error {
+	if _, ok := hub.listened[channel]; ok {
+		return nil
+	}
+
+	// channel is an identifier, not a string literal
+	channelId := pgx.Identifier{channel}
+	if _, err := conn.Exec(ctx, fmt.Sprintf("listen %s", channelId.Sanitize())); err != nil {
+		return err
+	}
+
+	hub.listened[channel] = struct{}{}
+
+	return nil
+}
+
+func (hub *ChannelHub) send(s *ChannelSubscriber, notification *pgconn.Notification) {
+	select {
+	case s.Notifications <- notification:
+	default:
+		log.Println("Subscriber too slow, dropped from channel", s.Channel)
+		hub.remove(s)
+	}
+}
+
+func (hub *ChannelHub) remove(s *ChannelSubscriber) {
+	subscribers := hub.subscribers[s.Channel]
+	if _, ok := subscribers[s]; !ok {
+		return
+	}
+
+	delete(subscribers, s)
+	close(s.Notifications)
+
+	if len(subscribers) == 0 {
+		delete(hub.subscribers, s.Channel)
+		hub.wakeUp()
+	}
+}
+
+// interrupts the listening connection waiting for notifications, so it can update its subscriptions
+func (hub *ChannelHub) wakeUp() {
+	hub.dirty = true
+
+	if hub.wake != nil {
+		hub.wake()
+	}
+}
+
+// makes a request handler for a route to a notification channel, streamed as Server-Sent Events
+func (h *RequestHandler) makeChannelRouteHandler(route *Route) denco.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		ctx := r.Context()
+
+		tx, err := h.beginRequestTx(ctx, r, route, params)
+		if err != nil {
+			panic(err)
+		}
+		defer tx.Rollback(ctx)
+
+		if route.ChannelProcedure != "" {
+			// the procedure is called once without payload to check access to the channel
+			granted, err := checkChannelPayload(ctx, tx, route.ChannelProcedure, nil)
+			if err != nil {
+				panic(err)
+			}
+
+			if !granted {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("Access to channel denied."))
+				return
+			}
+		}
+
+		if err := h.commitRequestTx(ctx, w, tx); err != nil {
+			panic(err)
+		}
+
+		var filter *ChannelFilter
+		if route.ChannelFilter {
+			filter = &ChannelFilter{Procedure: route.ChannelProcedure, Role: tx.Role, Context: tx.Context}
+		}
+
+		subscriber := h.channels.Subscribe(route.ObjectName, filter)
+		defer h.channels.Unsubscribe(subscriber)
+
+		stream, err := OpenEventStream(w, r)
+		if err != nil {
+			panic(err)
+		}
+		defer stream.Close()
+
+		keepAlive, stopKeepAlive := keepAliveTicker(h.EventStreamKeepAliveSecs)
+		defer stopKeepAlive()
+
+		for {
+			select {
+			case <-stream.Done():
+				return
+			case <-keepAlive:
+				if err := stream.KeepAlive(); err != nil {
+					return
+				}
+			case notification, ok := <-subscriber.Notifications:
+				if !ok {
+					// subscriber was dropped, the client will reconnect
+					return
+				}
+
+				if err := stream.Send("", "", notification.Payload); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// calls procedures of subscribers in their role and context to know if a payload can be sent to them
+// a single transaction is used, each subscriber is checked in its own savepoint
+func (h *RequestHandler) filterChannelPayloads(payload string, subscribers []*ChannelSubscriber) ([]bool, error) {
+	ctx := context.Background()
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	granted := make([]bool, len(subscribers))
+
+	for i, s := range subscribers {
+		if granted[i], err = h.filterChannelPayload(ctx, tx, s.Filter, payload); err != nil {
+			log.Println("Error while filtering notification:", err)
+		}
+	}
+
+	return granted, nil
+}
+
+func (h *RequestHandler) filterChannelPayload(ctx context.Context, tx pgx.Tx, filter *ChannelFilter, payload string) (bool, error) {
+	// role and context variables are discarded with the savepoint
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer savepoint.Rollback(ctx)
+
+	if err := setTxContext(ctx, savepoint, h.StatementTimeoutSecs, filter.Role, h.ContextParameterName, filter.Context); err != nil {
+		return false, err
+	}
+
+	return checkChannelPayload(ctx, savepoint, filter.Procedure, payload)
+}
+
+// calls a channel's procedure, payload is nil when checking access to the channel
+func checkChannelPayload(ctx context.Context, tx pgx.Tx, procedure string, payload interface{}) (bool, error) {
+	sql := NewSqlBuilder()
+
+	if err := buildProcedureSqlQuery(&sql, procedure, false, false, map[string]interface{}{"payload": payload}); err != nil {
+		return false, err
+	}
+
+	// null is treated as false
+	var granted pgtype.Bool
+	if err := tx.QueryRow(ctx, sql.Sql(), sql.Values()...).Scan(&granted); err != nil {
+		log.Println("While executing:", sql.Sql())
+		return false, err
+	}
+
+	return granted.Status == pgtype.Present && granted.Bool, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	queryme "github.com/debackerl/queryme/go"
+	"github.com/jackc/pgx/v4"
+)
+
+// counts of records matching filters, requested by clients
+const (
+	CountExact     = "exact"     // count(*) over the filter
+	CountPlanned   = "planned"   // estimate of the planner
+	CountEstimated = "estimated" // exact below a threshold, planned above
+)
+
+// returns the count mode requested in the query string or in the Prefer header, e.g. Prefer: count=exact
+func parseCountMode(r *http.Request, countQueryName string) (string, error) {
+	mode := ""
+	if countQueryName != "" {
+		mode = r.URL.Query().Get(countQueryName)
+	}
+
+	if mode == "" {
+		for _, prefer := range r.Header.Values("Prefer") {
+			for _, preference := range strings.Split(prefer, ",") {
+				preference = strings.TrimSpace(preference)
+				if strings.HasPrefix(preference, "count=") {
+					mode = preference[len("count="):]
+				}
+			}
+		}
+	}
+
+	switch mode {
+	case "", CountExact, CountPlanned, CountEstimated:
+		return mode, nil
+	}
+
+	return "", &HttpError{Status: http.StatusBadRequest, Err: errors.New("Unknown count " + mode + ".")}
+}
+
+// counts records of the relation matching the filter, in the request's transaction
+func (h *RequestHandler) countRecords(ctx context.Context, tx pgx.Tx, route *Route, filter queryme.Predicate, mode string) (int64, error) {
+	if mode == CountExact {
+		return exactCount(ctx, tx, h.FtsFunctionName, route, filter)
+	}
+
+	count, err := plannedCount(ctx, tx, h.FtsFunctionName, route, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	if mode == CountEstimated && count < h.CountEstimateThreshold {
+		return exactCount(ctx, tx, h.FtsFunctionName, route, filter)
+	}
+
+	return count, nil
+}
+
+func exactCount(ctx context.Context, tx pgx.Tx, ftsFunction string, route *Route, filter queryme.Predicate) (int64, error) {
+	sql := NewSqlBuilder()
+	if err := buildSelectSqlQuery(&sql, ftsFunction, route.ParametersTypes, "count(*)", nil, route.ObjectName, filter, nil, 0, 0); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if err := tx.QueryRow(ctx, sql.Sql(), sql.Values()...).Scan(&count); err != nil {
+		log.Println("While executing:", sql.Sql())
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// reads the number of rows estimated by the planner, from statistics of the relation
+func plannedCount(ctx context.Context, tx pgx.Tx, ftsFunction string, route *Route, filter queryme.Predicate) (int64, error) {
+	sql := NewSqlBuilder()
+	sql.WriteSql("EXPLAIN (FORMAT JSON) ")
+	if err := buildSelectSqlQuery(&sql, ftsFunction, route.ParametersTypes, "1", nil, route.ObjectName, filter, nil, 0, 0); err != nil {
+		return 0, err
+	}
+
+	var raw []byte
+	if err := tx.QueryRow(ctx, sql.Sql(), sql.Values()...).Scan(&raw); err != nil {
+		log.Println("While executing:", sql.Sql())
+		return 0, err
+	}
+
+	var plans []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		}
+	}
+	if err := json.Unmarshal(raw, &plans); err != nil {
+		return 0, err
+	}
+	if len(plans) == 0 {
+		return 0, errors.New("Empty query plan.")
+	}
+
+	return int64(plans[0].Plan.Rows), nil
+}
+
+// sets the Content-Range header, e.g. records 0-9/100
+// the range is unknown for empty pages and for pages of cursors, e.g. records */100
+func setContentRange(w http.ResponseWriter, page *Page, bounds *PageBounds, count int64) {
+	position := "*"
+	if bounds.Count > 0 && (page == nil || !page.Keyset || page.Cursor == nil) {
+		offset := int64(0)
+		if page != nil {
+			offset = page.Offset
+		}
+		position = strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+bounds.Count-1, 10)
+	}
+
+	w.Header().Set("Content-Range", "records "+position+"/"+strconv.FormatInt(count, 10))
+}
+
+// starts a JSON envelope of records with their count, {"count":100,"records":[...]}
+func beginCountEnvelope(responder RecordSetVisitor, count int64) error {
+	if err := responder.BeginObject(nil); err != nil {
+		return err
+	}
+	if err := responder.String(nil, "count"); err != nil {
+		return err
+	}
+	if err := responder.Integer(nil, count); err != nil {
+		return err
+	}
+	return responder.String(nil, "records")
+}
+
+func endCountEnvelope(responder RecordSetVisitor) error {
+	return responder.EndObject(nil)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCountMode(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		prefer []string
+		mode   string
+		valid  bool
+	}{
+		{"none", "", nil, "", true},
+		{"query string", "count=exact", nil, CountExact, true},
+		{"planned", "count=planned", nil, CountPlanned, true},
+		{"estimated", "count=estimated", nil, CountEstimated, true},
+		{"prefer header", "", []string{"count=planned"}, CountPlanned, true},
+		{"among preferences", "", []string{"return=representation, count=estimated"}, CountEstimated, true},
+		{"among prefer headers", "", []string{"return=minimal", "count=exact"}, CountExact, true},
+		{"query string over header", "count=exact", []string{"count=planned"}, CountExact, true},
+		{"other preference", "", []string{"return=minimal"}, "", true},
+		{"unknown in query string", "count=all", nil, "", false},
+		{"unknown in header", "", []string{"count=all"}, "", false},
+		{"case sensitive", "count=Exact", nil, "", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/?"+test.query, nil)
+		for _, prefer := range test.prefer {
+			r.Header.Add("Prefer", prefer)
+		}
+
+		mode, err := parseCountMode(r, "count")
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: valid %v expected, got error %v", test.name, test.valid, err)
+		} else if mode != test.mode {
+			t.Errorf("%s: %q expected, got %q", test.name, test.mode, mode)
+		}
+	}
+
+	// the query parameter is disabled, only the header is read
+	r := httptest.NewRequest("GET", "/?count=exact", nil)
+	if mode, err := parseCountMode(r, ""); err != nil || mode != "" {
+		t.Errorf("count read from disabled query parameter: %q, %v", mode, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	credentialsCacheTTL  = 5 * time.Minute
+	credentialsCacheSize = 1024
+)
+
+// passwords verified recently, to avoid a PBKDF2 computation per request
+var verifiedCredentials = &CredentialsCache{}
+
+// CredentialsCache remembers successful verifications, keyed by a hash of the stored verifier and the password,
+// so that changing a password invalidates its entries
+type CredentialsCache struct {
+	mutex   sync.Mutex
+	entries map[[sha256.Size]byte]time.Time
+}
+
+// checks the password against the verifier stored in pg_authid
+func (c *CredentialsCache) Check(role string, password string, verifier string) bool {
+	key := sha256.Sum256([]byte(role + "\x00" + verifier + "\x00" + password))
+
+	c.mutex.Lock()
+	expiry, ok := c.entries[key]
+	c.mutex.Unlock()
+
+	if ok && time.Now().Before(expiry) {
+		return true
+	}
+
+	if !checkPasswordVerifier(role, password, verifier) {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.entries == nil || len(c.entries) >= credentialsCacheSize {
+		c.entries = make(map[[sha256.Size]byte]time.Time)
+	}
+	c.entries[key] = time.Now().Add(credentialsCacheTTL)
+
+	return true
+}
+
+// verifies md5 and SCRAM-SHA-256 verifiers as stored by PostgreSQL
+func checkPasswordVerifier(role string, password string, verifier string) bool {
+	if strings.HasPrefix(verifier, "md5") {
+		sum := md5.Sum([]byte(password + role))
+		expected := fmt.Sprintf("md5%x", sum)
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(verifier)) == 1
+	}
+
+	if strings.HasPrefix(verifier, "SCRAM-SHA-256$") {
+		return checkScramVerifier(password, verifier)
+	}
+
+	return false
+}
+
+// verifies SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+// passwords are used as is, PostgreSQL applies SASLprep which only differs for some non-ASCII passwords
+func checkScramVerifier(password string, verifier string) bool {
+	parts := strings.Split(strings.TrimPrefix(verifier, "SCRAM-SHA-256$"), "$")
+	if len(parts) != 2 {
+		return false
+	}
+
+	iterationsAndSalt := strings.Split(parts[0], ":")
+	keys := strings.Split(parts[1], ":")
+	if len(iterationsAndSalt) != 2 || len(keys) != 2 {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(iterationsAndSalt[0])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(iterationsAndSalt[1])
+	if err != nil {
+		return false
+	}
+
+	storedKey, err := base64.StdEncoding.DecodeString(keys[0])
+	if err != nil {
+		return false
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+
+	mac := hmac.New(sha256.New, saltedPassword)
+	mac.Write([]byte("Client Key"))
+	clientKey := mac.Sum(nil)
+
+	computedStoredKey := sha256.Sum256(clientKey)
+
+	return subtle.ConstantTimeCompare(computedStoredKey[:], storedKey) == 1
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// builds a verifier like PostgreSQL stores in pg_authid
+func makeScramVerifier(password string, salt []byte, iterations int) string {
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+
+	mac := hmac.New(sha256.New, saltedPassword)
+	mac.Write([]byte("Client Key"))
+	storedKey := sha256.Sum256(mac.Sum(nil))
+
+	mac = hmac.New(sha256.New, saltedPassword)
+	mac.Write([]byte("Server Key"))
+	serverKey := mac.Sum(nil)
+
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", iterations,
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(storedKey[:]),
+		base64.StdEncoding.EncodeToString(serverKey))
+}
+
+func TestCheckPasswordVerifier(t *testing.T) {
+	scram := makeScramVerifier("pencil", []byte("0123456789abcdef"), 4096)
+	md5Verifier := fmt.Sprintf("md5%x", md5.Sum([]byte("pencil"+"alice")))
+
+	tests := []struct {
+		name     string
+		role     string
+		password string
+		verifier string
+		valid    bool
+	}{
+		{"scram", "alice", "pencil", scram, true},
+		{"scram wrong password", "alice", "pen", scram, false},
+		{"scram empty password", "alice", "", scram, false},
+		{"scram invalid iterations", "alice", "pencil", "SCRAM-SHA-256$x:MDEy$a:b", false},
+		{"scram zero iterations", "alice", "pencil", "SCRAM-SHA-256$0:MDEy$a:b", false},
+		{"scram missing keys", "alice", "pencil", "SCRAM-SHA-256$4096:MDEy", false},
+		{"scram invalid salt", "alice", "pencil", "SCRAM-SHA-256$4096:***$a:b", false},
+		{"md5", "alice", "pencil", md5Verifier, true},
+		{"md5 salted by another role", "bob", "pencil", md5Verifier, false},
+		{"md5 wrong password", "alice", "pen", md5Verifier, false},
+		{"plain text", "alice", "pencil", "pencil", false},
+		{"no verifier", "alice", "", "", false},
+	}
+
+	for _, test := range tests {
+		if valid := checkPasswordVerifier(test.role, test.password, test.verifier); valid != test.valid {
+			t.Errorf("%s: %v expected, got %v", test.name, test.valid, valid)
+		}
+	}
+}
+
+func TestCredentialsCache(t *testing.T) {
+	cache := &CredentialsCache{}
+	verifier := makeScramVerifier("pencil", []byte("salt"), 16)
+
+	if !cache.Check("alice", "pencil", verifier) {
+		t.Fatal("valid password refused")
+	}
+	if !cache.Check("alice", "pencil", verifier) {
+		t.Error("cached password refused")
+	}
+	if cache.Check("alice", "pen", verifier) {
+		t.Error("wrong password accepted")
+	}
+	if cache.Check("alice", "pencil", makeScramVerifier("other", []byte("salt"), 16)) {
+		t.Error("cached password accepted after the verifier changed")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/naoina/denco"
+)
+
+// defenses against cross-site request forgery
+const (
+	CsrfNone         = "none"
+	CsrfDoubleSubmit = "double_submit" // a cookie must be sent back in a header
+	CsrfOrigin       = "origin"        // Origin or Referer header must be an allowed origin
+)
+
+type csrfTokenKey struct{}
+
+// token of the request, exposed as context variable
+type csrfToken struct {
+	Variable string
+	Value    string
+}
+
+func checkCsrfMode(mode string) error {
+	switch mode {
+	case "", CsrfNone, CsrfDoubleSubmit, CsrfOrigin:
+		return nil
+	}
+
+	return errors.New("Unknown CSRF protection " + mode + ".")
+}
+
+// returns the protection of the route, the global one unless set by the route
+func (h *RequestHandler) csrfMode(route *Route) string {
+	if route.CsrfProtection != "" {
+		return route.CsrfProtection
+	}
+
+	return h.CsrfMode
+}
+
+// makes a request handler answering 403 to POST, PUT and DELETE requests failing CSRF checks
+// with double-submit tokens, a token cookie is issued to clients without one
+func (h *RequestHandler) makeCsrfHandler(route *Route, mode string, next denco.HandlerFunc) denco.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		if isCsrfImmune(r) {
+			next(w, r, params)
+			return
+		}
+
+		switch mode {
+		case CsrfDoubleSubmit:
+			token := ""
+			if cookie, err := r.Cookie(h.CsrfCookieName); err == nil {
+				token = cookie.Value
+			}
+
+			if route.Method != "get" {
+				header := r.Header.Get(h.CsrfHeaderName)
+				if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(header)) != 1 {
+					writeCsrfFailure(w, "Invalid CSRF token.")
+					return
+				}
+			}
+
+			if token == "" {
+				token = h.issueCsrfToken(w)
+			}
+
+			if h.CsrfContextVariable != "" {
+				r = r.WithContext(context.WithValue(r.Context(), csrfTokenKey{}, &csrfToken{Variable: h.CsrfContextVariable, Value: token}))
+			}
+		case CsrfOrigin:
+			if route.Method != "get" && !h.isAllowedOrigin(r) {
+				writeCsrfFailure(w, "Origin not allowed.")
+				return
+			}
+		}
+
+		next(w, r, params)
+	}
+}
+
+// returns true if the client is authenticated by credentials browsers never send on their own
+// like bearer tokens, API keys, and signed URLs, Basic credentials are excluded since browsers replay them
+func isCsrfImmune(r *http.Request) bool {
+	if requestTokenIdentity(r) != nil {
+		return true
+	}
+
+	if authorization := r.Header.Get("Authorization"); authorization != "" && !strings.HasPrefix(authorization, "Basic ") {
+		return true
+	}
+
+	return false
+}
+
+// sets a random token as cookie, readable by JavaScript to be sent back in a header
+func (h *RequestHandler) issueCsrfToken(w http.ResponseWriter) string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		panic(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	path := h.Schema.CookiesPath
+	if path == "" {
+		path = "/"
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.CsrfCookieName,
+		Value:    token,
+		Path:     path,
+		Domain:   h.Schema.CookiesDomain,
+		Secure:   !h.Schema.CookiesDisableSecure,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return token
+}
+
+// checks the Origin header, or the origin of the Referer header if missing
+// without allowed origins in the configuration, the origin must be the requested host
+func (h *RequestHandler) isAllowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		referer, err := url.Parse(r.Referer())
+		if err != nil || referer.Host == "" {
+			return false
+		}
+		origin = referer.Scheme + "://" + referer.Host
+	}
+
+	if len(h.CsrfAllowedOrigins) == 0 {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		return origin == scheme+"://"+r.Host
+	}
+
+	for _, allowed := range h.CsrfAllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeCsrfFailure(w http.ResponseWriter, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(message))
+}
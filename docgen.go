@@ -17,12 +17,19 @@ import (
 )
 
 type DocumentationGenerator struct {
-	DbConnConfig    *pgx.ConnConfig
-	Schema          Schema
-	SearchPath      string
-	FilterQueryName string
-	SortQueryName   string
-	LimitQueryName  string
+	DbConnConfig       *pgx.ConnConfig
+	Schema             Schema
+	SearchPath         string
+	FilterQueryName    string
+	SortQueryName      string
+	LimitQueryName     string
+	SelectQueryName    string
+	OffsetQueryName    string
+	CursorQueryName    string
+	CountQueryName     string
+	GroupQueryName     string
+	AggregateQueryName string
+	EmbedQueryName     string
 }
 
 func (g *DocumentationGenerator) GenerateDocumentation(outputPath string) {
@@ -47,11 +54,16 @@ func (g *DocumentationGenerator) GenerateDocumentation(outputPath string) {
 	defer tx.Rollback(ctx)
 
 	var routes []*Route
-	routes, err = g.Schema.LoadRoutes(ctx, tx, g.SearchPath)
+	var routeErrors []*RouteError
+	routes, routeErrors, err = g.Schema.LoadRoutes(ctx, tx, g.SearchPath)
 	if err != nil {
 		log.Fatalln("Could not load routes:", err)
 	}
 
+	for _, routeError := range routeErrors {
+		log.Println("Invalid route not documented:", routeError)
+	}
+
 	var f *os.File
 	f, err = os.Create(outputPath)
 	if err != nil {
@@ -99,6 +111,41 @@ func (g *DocumentationGenerator) GenerateDocumentation(outputPath string) {
 	wtr.WriteString("- `")
 	wtr.WriteString(g.LimitQueryName)
 	wtr.WriteString("`, limit\r\n")
+	if g.SelectQueryName != "" {
+		wtr.WriteString("- `")
+		wtr.WriteString(g.SelectQueryName)
+		wtr.WriteString("`, comma-separated list of columns to return, in this order, as `column` or `alias:column` (*get*, *post*, and *put* only)\r\n")
+	}
+	if g.OffsetQueryName != "" {
+		wtr.WriteString("- `")
+		wtr.WriteString(g.OffsetQueryName)
+		wtr.WriteString("`, number of records to skip (*get* only)\r\n")
+	}
+	if g.CursorQueryName != "" {
+		wtr.WriteString("- `")
+		wtr.WriteString(g.CursorQueryName)
+		wtr.WriteString("`, opaque cursor of the `next` or `prev` link of the `Link` response header (*get* only, routes with keyset pagination)\r\n")
+	}
+	if g.CountQueryName != "" {
+		wtr.WriteString("- `")
+		wtr.WriteString(g.CountQueryName)
+		wtr.WriteString("`, `exact`, `planned`, or `estimated` count of records returned in the `Content-Range` response header, also requested by `Prefer: count=exact` (*get* only)\r\n")
+	}
+	if g.GroupQueryName != "" {
+		wtr.WriteString("- `")
+		wtr.WriteString(g.GroupQueryName)
+		wtr.WriteString("`, comma-separated list of columns to group by, as `column`, `alias:column`, or `alias:unit(column)` to truncate dates to a `minute`, `hour`, `day`, `week`, `month`, `quarter`, or `year` (*get* only, routes with aggregation)\r\n")
+	}
+	if g.AggregateQueryName != "" {
+		wtr.WriteString("- `")
+		wtr.WriteString(g.AggregateQueryName)
+		wtr.WriteString("`, comma-separated list of aggregates, as `alias:function(column)` where function is `count`, `count_distinct`, `sum`, `avg`, `min`, or `max` (*get* only, routes with aggregation)\r\n")
+	}
+	if g.EmbedQueryName != "" {
+		wtr.WriteString("- `")
+		wtr.WriteString(g.EmbedQueryName)
+		wtr.WriteString("`, comma-separated list of related relations to embed in records through foreign keys, as `relation`, `alias:relation`, or `relation!constraint` (*get* only)\r\n")
+	}
 	wtr.WriteString("\r\n")
 	wtr.WriteString("### Responses\r\n")
 	wtr.WriteString("\r\n")
@@ -232,6 +279,21 @@ func (g *DocumentationGenerator) GenerateDocumentation(outputPath string) {
 		table.Append([]string{fmt.Sprintf("%d", route.RouteID), route.ObjectType, cacheControl, maxAge})
 		table.Render()
 
+		if len(route.AllowedRoles) > 0 || len(route.RequiredScopes) > 0 {
+			wtr.WriteString("\r\n**Authorization**\r\n\r\n")
+
+			if len(route.AllowedRoles) > 0 {
+				wtr.WriteString("- roles: `")
+				wtr.WriteString(strings.Join(route.AllowedRoles, "`, `"))
+				wtr.WriteString("`\r\n")
+			}
+			if len(route.RequiredScopes) > 0 {
+				wtr.WriteString("- scopes: `")
+				wtr.WriteString(strings.Join(route.RequiredScopes, "`, `"))
+				wtr.WriteString("`\r\n")
+			}
+		}
+
 		wtr.WriteString("\r\n**Arguments**\r\n\r\n")
 
 		table = tablewriter.NewWriter(wtr)
@@ -310,6 +372,17 @@ func (g *DocumentationGenerator) GenerateDocumentation(outputPath string) {
 
 			wtr.WriteString(link)
 			wtr.WriteString("\r\n")
+
+			if route.LargeObject {
+				wtr.WriteString("\r\nlarge object streamed in chunks, supporting Range requests\r\n")
+			}
+
+			if route.Async {
+				wtr.WriteString("\r\nexecuted in background, the response is a job whose URL is given by the `Location` header\r\n")
+			}
+
+		case "channel":
+			wtr.WriteString("stream of notifications as Server-Sent Events (`text/event-stream`), each event's data is the payload of a notification\r\n")
 		}
 
 		if route.ContextHeaders.Status == pgtype.Present && len(route.ContextHeaders.Map) > 0 {
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// alias of related relations in subqueries of embedded records
+const embeddedRelationAlias = "pgasus_embedded"
+
+// ForeignKey relates a relation to another one, in either direction
+type ForeignKey struct {
+	Name          string // name of the constraint
+	ToMany        bool   // true if the other relation references this one, false if this relation references the other one
+	RelationOid   pgtype.OID
+	RelationName  string
+	Columns       []string // columns of this relation
+	RemoteColumns []string // columns of the other relation, in the same order
+}
+
+// Embedding is a related resource nested in each record, an array of records if ToMany, an object otherwise
+type Embedding struct {
+	Alias   string
+	Key     *ForeignKey
+	Route   *Route // GET route exposing the related relation, whose hidden fields, constants, limit, context, and hooks apply
+	request []byte // argument of hook procedures for the route
+}
+
+// loads foreign keys of the route's relation and those referencing it
+func loadForeignKeys(ctx context.Context, tx pgx.Tx, route *Route) error {
+	sql := `SELECT con.conname, false, con.confrelid, con.confrelid::regclass::text, ARRAY(SELECT att.attname::text FROM unnest(con.conkey) WITH ORDINALITY AS k(attnum, i) INNER JOIN pg_attribute att ON att.attrelid = con.conrelid AND att.attnum = k.attnum ORDER BY k.i), ARRAY(SELECT att.attname::text FROM unnest(con.confkey) WITH ORDINALITY AS k(attnum, i) INNER JOIN pg_attribute att ON att.attrelid = con.confrelid AND att.attnum = k.attnum ORDER BY k.i) FROM pg_constraint con WHERE con.contype = 'f' AND con.conrelid = $1
+UNION ALL
+SELECT con.conname, true, con.conrelid, con.conrelid::regclass::text, ARRAY(SELECT att.attname::text FROM unnest(con.confkey) WITH ORDINALITY AS k(attnum, i) INNER JOIN pg_attribute att ON att.attrelid = con.confrelid AND att.attnum = k.attnum ORDER BY k.i), ARRAY(SELECT att.attname::text FROM unnest(con.conkey) WITH ORDINALITY AS k(attnum, i) INNER JOIN pg_attribute att ON att.attrelid = con.conrelid AND att.attnum = k.attnum ORDER BY k.i) FROM pg_constraint con WHERE con.contype = 'f' AND con.confrelid = $1`
+
+	rows, err := tx.Query(ctx, sql, route.RelationOid)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	route.ForeignKeys = nil
+
+	for rows.Next() {
+		key := &ForeignKey{}
+		if err := rows.Scan(&key.Name, &key.ToMany, &key.RelationOid, &key.RelationName, &key.Columns, &key.RemoteColumns); err != nil {
+			return err
+		}
+		route.ForeignKeys = append(route.ForeignKeys, key)
+	}
+
+	return rows.Err()
+}
+
+// returns the GET route exposing the relation, an error unless exactly one route exposes it
+// routes with variables are ignored, since variables can't be applied to embedded records
+func (h *RequestHandler) embeddableRoute(oid pgtype.OID, relation string) (*Route, error) {
+	routes, _ := h.routes.Load().([]*Route)
+
+	var route *Route
+	for _, r := range routes {
+		if r.Method == "get" && r.ObjectType == "relation" && r.RelationOid == oid && r.ContentColumn == "" && !strings.ContainsAny(r.UrlPath, ":*") {
+			// hidden fields, constants, and authorization of routes may differ, none is chosen arbitrarily
+			if route != nil {
+				return nil, embeddingError("Relation " + relation + " exposed by several GET routes.")
+			}
+			route = r
+		}
+	}
+
+	if route == nil {
+		return nil, embeddingError("Relation " + relation + " not exposed by a GET route.")
+	}
+
+	return route, nil
+}
+
+// reads related resources to embed from the query string, e.g. embed=customers,lines:order_lines!order_lines_order_fkey
+// related relations are named as relation, or relation!constraint if several foreign keys relate both relations
+func (h *RequestHandler) parseEmbeddings(r *http.Request, embedQueryName string, route *Route) ([]*Embedding, error) {
+	if embedQueryName == "" {
+		return nil, nil
+	}
+
+	raw := r.URL.Query().Get(embedQueryName)
+	if raw == "" {
+		return nil, nil
+	}
+
+	embeddings := make([]*Embedding, 0, 4)
+	aliases := make(map[string]struct{}, 4)
+
+	for _, item := range strings.Split(raw, ",") {
+		alias := ""
+		name := strings.TrimSpace(item)
+		if i := strings.IndexRune(name, ':'); i >= 0 {
+			alias = strings.TrimSpace(name[:i])
+			name = strings.TrimSpace(name[i+1:])
+		}
+
+		relation, constraint := name, ""
+		if i := strings.IndexRune(name, '!'); i >= 0 {
+			relation, constraint = name[:i], name[i+1:]
+		}
+
+		var key *ForeignKey
+		for _, k := range route.ForeignKeys {
+			if k.RelationName == relation && (constraint == "" || k.Name == constraint) {
+				if key != nil {
+					return nil, embeddingError("Ambiguous embedding " + name + ", name its foreign key as relation!constraint.")
+				}
+				key = k
+			}
+		}
+		if key == nil {
+			return nil, embeddingError("No foreign key relates " + name + ".")
+		}
+
+		embedded, err := h.embeddableRoute(key.RelationOid, relation)
+		if err != nil {
+			return nil, err
+		}
+
+		// records of arrays are sorted by the unique cursor column, so that limits truncate them the same way
+		if key.ToMany && embedded.CursorColumn == "" {
+			return nil, embeddingError("Relation " + relation + " can't be embedded as an array, its GET route has no cursor column.")
+		}
+
+		if alias == "" {
+			alias = relation
+		}
+
+		if _, ok := aliases[alias]; ok {
+			return nil, embeddingError("Duplicate embedding " + alias + ".")
+		}
+		if _, ok := route.ParametersTypes[alias]; ok || alias == cursorColumnName {
+			return nil, embeddingError("Embedding " + alias + " conflicts with a column, rename it as alias:" + name + ".")
+		}
+		aliases[alias] = struct{}{}
+
+		embeddings = append(embeddings, &Embedding{Alias: alias, Key: key, Route: embedded})
+	}
+
+	return embeddings, nil
+}
+
+// checks allowed roles, required scopes, and routes of API keys of routes of embedded resources
+func checkEmbeddingsAuthorization(r *http.Request, embeddings []*Embedding, role string) error {
+	identity := requestTokenIdentity(r)
+
+	for _, embedding := range embeddings {
+		if !isRouteAuthorized(embedding.Route, role, identity) {
+			return &HttpError{Status: http.StatusForbidden, Err: errors.New("Embedding " + embedding.Alias + " not allowed.")}
+		}
+	}
+
+	return nil
+}
+
+// merges context variables of routes of embedded resources into the context of the request
+// records are read in one transaction, so variables set by several routes must have the same value
+func (h *RequestHandler) mergeEmbeddingsContext(r *http.Request, context map[string]string, embeddings []*Embedding) error {
+	for _, embedding := range embeddings {
+		// embedded routes have no variables
+		embedded := embedding.Route
+		for k, v := range makeContext(r, h.DefaultContext, nil, embedded.ContextInputCookies, embedded.ContextParameters, embedded.ContextHeaders) {
+			if current, ok := context[k]; ok && current != v {
+				return embeddingError("Context variable " + k + " of embedding " + embedding.Alias + " conflicts with the route.")
+			}
+			context[k] = v
+		}
+	}
+
+	return nil
+}
+
+// calls the pre-request procedure for routes of embedded resources, like for their own requests
+// procedures can reject the request, but not change its role since records are read in one transaction
+func (h *RequestHandler) embeddingsPreRequestHooks(ctx context.Context, tx pgx.Tx, r *http.Request, embeddings []*Embedding, role string) error {
+	for _, embedding := range embeddings {
+		embedding.request = h.hookRequest(embedding.Route, r)
+
+		newRole, err := h.preRequestHook(ctx, tx, embedding.request, role)
+		if err != nil {
+			return err
+		}
+		if newRole != role {
+			return errors.New("Pre-request procedure changed the role of embedding " + embedding.Alias + ".")
+		}
+	}
+
+	return nil
+}
+
+// calls the post-request procedure for routes of embedded resources
+func (h *RequestHandler) embeddingsPostRequestHooks(ctx context.Context, tx pgx.Tx, embeddings []*Embedding) error {
+	for _, embedding := range embeddings {
+		if err := h.postRequestHook(ctx, tx, embedding.request); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lists embeddings truncated by the limit of their route in some records, e.g. X-Embedded-Truncated: lines
+func setEmbeddingsTruncated(w http.ResponseWriter, bounds *PageBounds) {
+	if len(bounds.Truncated) > 0 {
+		w.Header().Set("X-Embedded-Truncated", strings.Join(bounds.Truncated, ","))
+	}
+}
+
+func embeddingError(message string) error {
+	return &HttpError{Status: http.StatusBadRequest, Err: errors.New(message)}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgtype"
+)
+
+func embeddingTestHandler() (*RequestHandler, *Route) {
+	orders := &Route{
+		Method:          "get",
+		ObjectType:      "relation",
+		ObjectName:      "orders",
+		UrlPath:         "/orders",
+		RelationOid:     1,
+		ParametersTypes: map[string]ArgumentType{"id": {}, "customer_id": {}, "total": {}},
+		ForeignKeys: []*ForeignKey{
+			{Name: "orders_customer_fkey", RelationOid: 2, RelationName: "customers", Columns: []string{"customer_id"}, RemoteColumns: []string{"id"}},
+			{Name: "lines_order_fkey", ToMany: true, RelationOid: 3, RelationName: "lines", Columns: []string{"id"}, RemoteColumns: []string{"order_id"}},
+			{Name: "notes_order_fkey", ToMany: true, RelationOid: 4, RelationName: "notes", Columns: []string{"id"}, RemoteColumns: []string{"order_id"}},
+		},
+	}
+
+	h := &RequestHandler{}
+	h.routes.Store([]*Route{
+		orders,
+		{Method: "get", ObjectType: "relation", ObjectName: "customers", UrlPath: "/customers", RelationOid: 2, SelectedColumns: `"id","name"`},
+		{Method: "get", ObjectType: "relation", ObjectName: "lines", UrlPath: "/lines", RelationOid: 3, SelectedColumns: `"id","order_id"`, CursorColumn: "id", MaxLimit: 10},
+		{Method: "get", ObjectType: "relation", ObjectName: "notes", UrlPath: "/notes", RelationOid: 4, SelectedColumns: `"order_id","text"`},
+	})
+
+	return h, orders
+}
+
+func TestParseEmbeddings(t *testing.T) {
+	h, orders := embeddingTestHandler()
+
+	tests := []struct {
+		embed   string
+		aliases string // empty if the request must be refused
+	}{
+		{"customers", "customers"},
+		{"customers,lines", "customers,lines"},
+		{"c:customers,items:lines!lines_order_fkey", "c,items"},
+		{"customers,customers", ""},
+		{"lines,lines:customers", ""},
+		{"total:customers", ""},
+		{"pgasus_cursor:customers", ""},
+		{"products", ""},
+		{"lines!other_fkey", ""},
+		{"notes", ""}, // arrays are sorted by the cursor column of their route
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/orders?embed="+url.QueryEscape(test.embed), nil)
+
+		embeddings, err := h.parseEmbeddings(r, "embed", orders)
+
+		if test.aliases == "" {
+			if err == nil {
+				t.Errorf("%s: embeddings accepted", test.embed)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.embed, err)
+			continue
+		}
+
+		aliases := make([]string, len(embeddings))
+		for i, embedding := range embeddings {
+			aliases[i] = embedding.Alias
+		}
+		if strings.Join(aliases, ",") != test.aliases {
+			t.Errorf("%s: %s expected, got %v", test.embed, test.aliases, aliases)
+		}
+	}
+}
+
+func TestWriteEmbeddings(t *testing.T) {
+	h, orders := embeddingTestHandler()
+
+	r := httptest.NewRequest("GET", "/orders?embed=customers,lines", nil)
+	embeddings, err := h.parseEmbeddings(r, "embed", orders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql := NewSqlBuilder()
+	writeEmbeddings(&sql, "", "orders", embeddings)
+
+	expected := `,(SELECT row_to_json("pgasus_embedded") FROM (SELECT "id","name" FROM "customers" AS "pgasus_embedded" WHERE "pgasus_embedded"."id"="orders"."customer_id" LIMIT 1) AS "pgasus_embedded") AS "customers"` +
+		`,(SELECT coalesce(json_agg("pgasus_embedded" ORDER BY "pgasus_embedded"."id"),'[]') FROM (SELECT "id","order_id" FROM "lines" AS "pgasus_embedded" WHERE "pgasus_embedded"."order_id"="orders"."id" ORDER BY "pgasus_embedded"."id" LIMIT $1) AS "pgasus_embedded") AS "lines"`
+	if sql.Sql() != expected {
+		t.Errorf("unexpected SQL %s", sql.Sql())
+	}
+
+	// one more record is read to know if arrays are truncated
+	if values := sql.Values(); len(values) != 1 || values[0] != int64(11) {
+		t.Errorf("unexpected values %v", values)
+	}
+}
+
+func TestEmbeddedFieldTruncation(t *testing.T) {
+	tests := []struct {
+		json      string
+		limit     int64
+		output    string
+		truncated bool
+	}{
+		{`[{"id":1},{"id":2}]`, 0, `[{"id":1},{"id":2}]`, false},
+		{`[{"id":1},{"id":2}]`, 2, `[{"id":1},{"id":2}]`, false},
+		{`[{"id":1},{"id":2},{"id":3}]`, 2, `[{"id":1},{"id":2}]`, true},
+		{`[]`, 2, `[]`, false},
+	}
+
+	for _, test := range tests {
+		w := NewJsonRecordSetWriter(0)
+		rs := &RecordSet{Visitor: w}
+
+		field := &EmbeddedField{Limit: test.limit}
+		field.JSON = pgtype.JSON{Bytes: []byte(test.json), Status: pgtype.Present}
+		field.Accept(rs, w)
+
+		if output := string(w.ToBytes()); output != test.output {
+			t.Errorf("%s: %s expected, got %s", test.json, test.output, output)
+		}
+		if field.Truncated != test.truncated {
+			t.Errorf("%s: truncated %v expected", test.json, test.truncated)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const EventStreamMimeType string = "text/event-stream; charset=utf-8"
+
+// EventStream writes Server-Sent Events to a hijacked HTTP connection,
+// this way long-lived streams are not subject to the server's read and write timeouts
+type EventStream struct {
+	conn   net.Conn
+	buf    *bufio.ReadWriter
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// hijacks the connection of given request, and sends HTTP headers of an event stream
+func OpenEventStream(w http.ResponseWriter, r *http.Request) (*EventStream, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("Event streams not supported by this connection.")
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// timeouts of the HTTP server are still set on the connection
+	conn.SetDeadline(time.Time{})
+
+	s := &EventStream{conn: conn, buf: buf}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	header := w.Header()
+	header.Set("Content-Type", EventStreamMimeType)
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "close")
+	header.Set("X-Accel-Buffering", "no")
+
+	buf.WriteString("HTTP/1.1 200 OK\r\n")
+	header.Write(buf)
+	buf.WriteString("\r\n")
+
+	if err := buf.Flush(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	// clients never send anything once the request is read, so any read ends the stream
+	go func() {
+		io.Copy(ioutil.Discard, buf)
+		s.cancel()
+	}()
+
+	return s, nil
+}
+
+// closed when the client disconnects, or when the stream is closed
+func (s *EventStream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// sends one event, id and event are optional
+func (s *EventStream) Send(id string, event string, data string) error {
+	if id != "" {
+		s.buf.WriteString("id: ")
+		s.buf.WriteString(id)
+		s.buf.WriteString("\n")
+	}
+
+	if event != "" {
+		s.buf.WriteString("event: ")
+		s.buf.WriteString(event)
+		s.buf.WriteString("\n")
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		s.buf.WriteString("data: ")
+		s.buf.WriteString(strings.TrimSuffix(line, "\r"))
+		s.buf.WriteString("\n")
+	}
+
+	s.buf.WriteString("\n")
+
+	return s.buf.Flush()
+}
+
+// sends a comment, ignored by clients, to keep proxies from closing idle streams
+func (s *EventStream) KeepAlive() error {
+	s.buf.WriteString(":\n\n")
+	return s.buf.Flush()
+}
+
+// returns a channel ticking when keep-alives are due, nil if secs is 0 to disable keep-alives
+// the returned function stops the ticker
+func keepAliveTicker(secs int) (<-chan time.Time, func()) {
+	if secs <= 0 {
+		return nil, func() {}
+	}
+
+	ticker := time.NewTicker(time.Duration(secs) * time.Second)
+	return ticker.C, ticker.Stop
+}
+
+func (s *EventStream) Close() {
+	s.cancel()
+	s.conn.Close()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/naoina/denco"
+)
+
+// sends a file to the client, answering Range and If-Range requests with partial content
+// a filename makes the browser save the file instead of displaying it
+func serveFile(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, contentType string, filename string, etag string) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	if filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+
+	// the name is only used to guess the content type, which is always set
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// returns the MIME type registered for the requested extension, if any
+func (h *RequestHandler) extensionContentType(r *http.Request) string {
+	// the following header is provided by this program just before routing
+	accept := r.Header.Get("X-Accept-Extension")
+
+	if mimeType, ok := h.BinaryFormats[accept]; ok {
+		return mimeType
+	}
+
+	return ""
+}
+
+// names of columns describing a file in a row
+type FileColumns struct {
+	Content     string
+	ContentType string
+	Filename    string
+	Etag        string
+}
+
+// metadata of a file, null when not provided
+type FileDescription struct {
+	ContentType pgtype.Text
+	Filename    pgtype.Text
+	Etag        pgtype.Text
+}
+
+// scans the current row, its content is the column named accordingly, or the only column of the row
+func scanFile(rows pgx.Rows, columns FileColumns, content interface{}, file *FileDescription) error {
+	fields := rows.FieldDescriptions()
+	dest := make([]interface{}, len(fields))
+
+	if len(fields) == 1 {
+		dest[0] = content
+	} else {
+		found := false
+
+		for i, field := range fields {
+			switch string(field.Name) {
+			case columns.Content:
+				dest[i] = content
+				found = true
+			case columns.ContentType:
+				dest[i] = &file.ContentType
+			case columns.Filename:
+				dest[i] = &file.Filename
+			case columns.Etag:
+				dest[i] = &file.Etag
+			}
+		}
+
+		if !found {
+			return errors.New("Column " + columns.Content + " expected.")
+		}
+	}
+
+	return rows.Scan(dest...)
+}
+
+// makes a request handler downloading the content column of the matching record as a file
+func (h *RequestHandler) makeRelationFileHandler(route *Route) denco.HandlerFunc {
+	columns := FileColumns{
+		Content:     route.ContentColumn,
+		ContentType: route.ContentTypeColumn,
+		Filename:    route.FilenameColumn,
+	}
+
+	selectedColumns := quoteIdentifier(route.ContentColumn)
+	if route.ContentTypeColumn != "" {
+		selectedColumns += "," + quoteIdentifier(route.ContentTypeColumn)
+	}
+	if route.FilenameColumn != "" {
+		selectedColumns += "," + quoteIdentifier(route.FilenameColumn)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		ctx := r.Context()
+		globalQuery := initGlobalQuery(route)
+		paramsDecoder(globalQuery, params, route.ParametersTypes)
+
+		filter, order, _, err := parseQueryString(r, globalQuery, h.FilterQueryName, h.SortQueryName, h.LimitQueryName, route.MaxLimit)
+		if err != nil {
+			panic(err)
+		}
+
+		tx, err := h.beginRequestTx(ctx, r, route, params)
+		if err != nil {
+			panic(err)
+		}
+		defer tx.Rollback(ctx)
+
+		sql := NewSqlBuilder()
+		if err := buildSelectSqlQuery(&sql, h.FtsFunctionName, route.ParametersTypes, selectedColumns, nil, route.ObjectName, filter, order, 2, 0); err != nil {
+			panic(err)
+		}
+
+		var content pgtype.Bytea
+		var file FileDescription
+
+		rows, err := tx.Query(ctx, sql.Sql(), sql.Values()...)
+		if err != nil {
+			log.Println("While executing:", sql.Sql())
+			panic(err)
+		}
+
+		found := rows.Next()
+		if found {
+			err = scanFile(rows, columns, &content, &file)
+		}
+		// a second record means the request doesn't identify a single file
+		several := err == nil && rows.Next()
+		rows.Close()
+
+		if err != nil {
+			panic(err)
+		}
+		if rows.Err() != nil {
+			panic(rows.Err())
+		}
+
+		if several {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Several records match, a single file must be selected."))
+			return
+		}
+
+		if !found || content.Status != pgtype.Present {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("File not found."))
+			return
+		}
+
+		if err := h.commitRequestTx(ctx, w, tx); err != nil {
+			panic(err)
+		}
+
+		contentType := file.ContentType.String
+		if contentType == "" {
+			contentType = h.extensionContentType(r)
+		}
+
+		// a strong validator is required by If-Range requests
+		etag := fmt.Sprintf("%x", sha256.Sum256(content.Bytes))
+
+		setCacheControl(w, route.TTL, route.IsPublic)
+		serveFile(w, r, bytes.NewReader(content.Bytes), contentType, file.Filename.String, etag)
+	}
+}
+
+// checks that the content column of a relation route can be downloaded as a file
+func checkRelationFileColumns(route *Route) error {
+	if typ, ok := route.ParametersTypes[route.ContentColumn]; !ok || typ.Name != "bytea" {
+		return errors.New("Content column '" + route.ContentColumn + "' of relation '" + route.ObjectName + "' must be of type bytea.")
+	}
+
+	for _, column := range []string{route.ContentTypeColumn, route.FilenameColumn} {
+		if _, ok := route.ParametersTypes[column]; column != "" && !ok {
+			return errors.New("Column '" + column + "' not found in relation '" + route.ObjectName + "'.")
+		}
+	}
+
+	for _, column := range []string{route.ContentColumn, route.ContentTypeColumn, route.FilenameColumn} {
+		if _, hidden := route.HiddenFields[column]; column != "" && hidden {
+			return errors.New("Column '" + column + "' of relation '" + route.ObjectName + "' is hidden, it can't be downloaded.")
+		}
+	}
+
+	return nil
+}
@@ -6,6 +6,7 @@ require (
 	github.com/antonholmquist/jason v1.0.0
 	github.com/debackerl/queryme v0.0.0-20160224205042-c53d5a785f6f
 	github.com/gorilla/handlers v1.5.1
+	github.com/jackc/pgconn v1.10.1
 	github.com/jackc/pgproto3/v2 v2.2.0
 	github.com/jackc/pgtype v1.9.1
 	github.com/jackc/pgx/v4 v4.14.1
@@ -13,6 +14,7 @@ require (
 	github.com/naoina/toml v0.1.1
 	github.com/olekukonko/tablewriter v0.0.5
 	github.com/tealeg/xlsx v1.0.5
+	golang.org/x/crypto v0.0.0-20211202192323-5770296d904e
 	gopkg.in/alecthomas/kingpin.v1 v1.3.7
 )
 
@@ -20,7 +22,6 @@ require (
 	github.com/alecthomas/units v0.0.0-20210927113745-59d0afb8317a // indirect
 	github.com/felixge/httpsnoop v1.0.2 // indirect
 	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
-	github.com/jackc/pgconn v1.10.1 // indirect
 	github.com/jackc/pgio v1.0.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
@@ -28,6 +29,5 @@ require (
 	github.com/mattn/go-runewidth v0.0.13 // indirect
 	github.com/naoina/go-stringutil v0.1.0 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
-	golang.org/x/crypto v0.0.0-20211202192323-5770296d904e // indirect
 	golang.org/x/text v0.3.7 // indirect
 )
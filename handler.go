@@ -15,6 +15,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -36,30 +37,106 @@ type RecordSetHttpResponder interface {
 type RequestHandler struct {
 	handler unsafe.Pointer // placed first to be 64-bit aligned
 	stop    int32
-
-	DbConnConfig             *pgx.ConnConfig
-	Verbose                  bool
-	UrlPrefix                string
-	UpdatesChannelName       string
-	SearchPath               string
-	MaxOpenConnections       int32
-	ContextParameterName     string
-	FtsFunctionName          string
-	StatementTimeoutSecs     int
-	DefaultCn                string
-	UpdateForwardedForHeader bool
-	MaxBodySizeKbytes        int64
-	MaxResponseSizeKbytes    int64
-	FilterQueryName          string
-	SortQueryName            string
-	LimitQueryName           string
-	DefaultContext           map[string]string
-	BinaryFormats            map[string]string
+	verbose int32 // Verbose, may be toggled while running
+
+	DbConnConfig                  *pgx.ConnConfig
+	Verbose                       bool
+	UrlPrefix                     string
+	UpdatesChannelName            string
+	SearchPath                    string
+	MaxOpenConnections            int32
+	ContextParameterName          string
+	FtsFunctionName               string
+	StatementTimeoutSecs          int
+	DefaultCn                     string
+	UpdateForwardedForHeader      bool
+	MaxBodySizeKbytes             int64
+	MaxLargeObjectSizeKbytes      int64
+	MaxResponseSizeKbytes         int64
+	FilterQueryName               string
+	SortQueryName                 string
+	LimitQueryName                string
+	SelectQueryName               string
+	OffsetQueryName               string
+	CursorQueryName               string
+	CountQueryName                string
+	GroupQueryName                string
+	AggregateQueryName            string
+	EmbedQueryName                string
+	CountEstimateThreshold        int64 // planned counts below this threshold are replaced by exact counts
+	CountEnvelope                 bool  // true if counted JSON records are wrapped in an object with their count
+	DefaultContext                map[string]string
+	BinaryFormats                 map[string]string
+	EventStreamKeepAliveSecs      int
+	ReplicationSlotName           string
+	ReplicationPublicationName    string
+	ReplicationTemporarySlot      bool
+	ReplicationBufferSize         int
+	JobsUrlPath                   string
+	MaxConcurrentJobs             int
+	JobsRetentionSecs             int
+	JobStatementTimeoutSecs       int
+	ReloadIntervalSecs            int
+	MaintenanceTableName          string
+	MaintenanceChannelName        string
+	MaintenanceMessage            string
+	MaintenanceRetryAfterSecs     int
+	JwtSecret                     string
+	JwtJwksPath                   string
+	JwtJwksReloadSecs             int
+	JwtAudience                   string
+	JwtIssuer                     string
+	JwtLeewaySecs                 int
+	JwtAllowNoExp                 bool
+	JwtRoleClaim                  string
+	JwtContextClaims              map[string]string // claims copied to context variables
+	JwtClaimsVariable             string            // context variable receiving all claims as JSON
+	ApiKeysTableName              string
+	ApiKeysChannelName            string
+	ApiKeysHeaderName             string
+	ApiKeysQueryParameter         string
+	ApiKeysKeyIDVariable          string // context variable receiving the ID of the client's key
+	ApiKeysScopesVariable         string // context variable receiving scopes of the client's key as JSON
+	ClientCertIdentity            string // attribute of client certificates used as identity
+	ClientCertRolesTableName      string // table mapping identities to roles, identities are roles if empty
+	ClientCertSubjectVariable     string
+	ClientCertFingerprintVariable string
+	AuditTableName                string // audit entries are inserted into this table, in the transaction of requests
+	AuditFilePath                 string // audit entries are written to this file as JSON lines
+	AuditRequestIDHeader          string
+	AuditTrustedProxies           []string // X-Forwarded-For is trusted from these addresses or networks to find client IPs
+	PreRequestProcedure           string   // called before the query of routes, can reject requests or change the role
+	PostRequestProcedure          string   // called after the query of routes, before commit
+	CsrfMode                      string   // global protection against cross-site request forgery
+	CsrfCookieName                string
+	CsrfHeaderName                string
+	CsrfAllowedOrigins            []string
+	CsrfContextVariable           string
+	SignedUrlsKey                 string
+	SignedUrlsRole                string
+	SignedUrlsContext             map[string]string
+	ReadinessPath                 string
+	MetricsPath                   string
 
 	Schema Schema
 
-	db         *pgxpool.Pool
-	reqLogFile *os.File
+	db          *pgxpool.Pool
+	reqLogFile  *os.File
+	channels    *ChannelHub
+	changes     *ChangeFeed
+	jobs        *JobStore
+	maintenance atomic.Value // *MaintenanceState
+	listener    atomic.Value // *ListenerState
+	reload      atomic.Value // *ReloadResult
+	routes      atomic.Value // []*Route, loaded successfully
+	inflight    *InflightRequests
+	jwt         *JwtVerifier
+
+	apiKeysByHash       atomic.Value // map[[sha256.Size]byte]*ApiKey
+	apiKeysUsage        *ApiKeysUsage
+	certRoles           atomic.Value // map[string]string
+	auditFile           *AuditFile
+	auditTrustedProxies []*net.IPNet
 }
 
 func (h *RequestHandler) OpenRequestsLogFile(path string) error {
@@ -91,6 +168,34 @@ func (h *RequestHandler) Load() error {
 	poolConfig.ConnConfig.TLSConfig = h.DbConnConfig.TLSConfig
 	poolConfig.MaxConns = h.MaxOpenConnections
 
+	h.setVerbose(h.Verbose)
+
+	if err := checkCertificateIdentity(h.ClientCertIdentity); err != nil {
+		return err
+	}
+
+	if err := checkCsrfMode(h.CsrfMode); err != nil {
+		return err
+	}
+	h.inflight = NewInflightRequests()
+
+	if h.JwtSecret != "" || h.JwtJwksPath != "" {
+		h.jwt = &JwtVerifier{
+			Secret:         []byte(h.JwtSecret),
+			JwksPath:       h.JwtJwksPath,
+			JwksReloadSecs: h.JwtJwksReloadSecs,
+			Audience:       h.JwtAudience,
+			Issuer:         h.JwtIssuer,
+			LeewaySecs:     h.JwtLeewaySecs,
+			AllowNoExp:     h.JwtAllowNoExp,
+		}
+
+		if err := h.jwt.LoadKeys(); err != nil {
+			return err
+		}
+		go h.jwt.ReloadKeys()
+	}
+
 	var err error
 	h.db, err = pgxpool.ConnectConfig(ctx, poolConfig)
 
@@ -98,8 +203,45 @@ func (h *RequestHandler) Load() error {
 		return err
 	}
 
+	h.channels = NewChannelHub()
+	go h.channels.FilterNotifications(h.filterChannelPayloads)
+
 	if h.UpdatesChannelName != "" {
-		h.listen()
+		h.channels.Reserve(h.UpdatesChannelName)
+	}
+
+	if h.MaintenanceChannelName != "" {
+		h.channels.Reserve(h.MaintenanceChannelName)
+	}
+
+	if h.ApiKeysChannelName != "" {
+		h.channels.Reserve(h.ApiKeysChannelName)
+	}
+
+	// the listening connection is also used by routes to notification channels
+	h.listen()
+
+	if h.ReplicationSlotName != "" {
+		h.changes = NewChangeFeed(h.ReplicationBufferSize)
+		h.replicate()
+	}
+
+	h.jobs = NewJobStore(h.MaxConcurrentJobs, h.JobsRetentionSecs)
+	go h.jobs.ExpireFinished()
+
+	if h.auditTrustedProxies, err = parseTrustedProxies(h.AuditTrustedProxies); err != nil {
+		return err
+	}
+
+	if h.AuditFilePath != "" {
+		if h.auditFile, err = OpenAuditFile(h.AuditFilePath); err != nil {
+			return err
+		}
+	}
+
+	if h.ApiKeysTableName != "" {
+		h.apiKeysUsage = NewApiKeysUsage()
+		h.recordApiKeysUsage()
 	}
 
 	if err := h.createHandlers(); err != nil {
@@ -112,6 +254,18 @@ func (h *RequestHandler) Load() error {
 func (h *RequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 
+	switch {
+	case h.ReadinessPath != "" && path == h.ReadinessPath:
+		h.serveReadiness(w, r)
+		return
+	case h.MetricsPath != "" && path == h.MetricsPath:
+		h.serveMetrics(w, r)
+		return
+	}
+
+	id := h.inflight.Begin(r)
+	defer h.inflight.End(id)
+
 	prefix := h.UrlPrefix
 	if !strings.HasPrefix(path, prefix) {
 		w.WriteHeader(400)
@@ -142,116 +296,270 @@ func (h *RequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		if h.SignedUrlsKey != "" {
+			if r = h.authenticateSignedUrl(w, r, prefix+path); r == nil {
+				return
+			}
+		}
+
+		if h.jwt != nil && requestTokenIdentity(r) == nil {
+			if r = h.authenticateBearer(w, r); r == nil {
+				return
+			}
+		}
+
+		if h.ApiKeysTableName != "" && requestTokenIdentity(r) == nil {
+			if r = h.authenticateApiKey(w, r); r == nil {
+				return
+			}
+		}
+
+		// client certificates are only used as identity if impersonation is active
+		if h.DefaultCn != "" && requestTokenIdentity(r) == nil {
+			if r = h.authenticateCertificate(w, r); r == nil {
+				return
+			}
+		}
+
 		(*(*http.Handler)(atomic.LoadPointer(&h.handler))).ServeHTTP(w, r)
 	}
 }
 
+func (h *RequestHandler) isVerbose() bool {
+	return atomic.LoadInt32(&h.verbose) != 0
+}
+
+func (h *RequestHandler) setVerbose(verbose bool) {
+	var v int32
+	if verbose {
+		v = 1
+	}
+	atomic.StoreInt32(&h.verbose, v)
+}
+
 // stop listening on the routes table
 func (h *RequestHandler) StopReloads() {
 	atomic.StoreInt32(&h.stop, 1)
 }
 
-// listens to updates on the routes table for auto-reload
+// listens to updates on the routes table for auto-reload, and to channels of subscribers
+// the connection is reestablished with exponential backoff, and routes are reloaded since notifications may have been missed
 func (h *RequestHandler) listen() {
 	go func() {
 		ctx := context.Background()
+		backoff := listenerMinBackoff
+		reconnecting := false
+		lastReload := time.Now()
 
 		log.Println("Listening to routes updates...")
 		for atomic.LoadInt32(&h.stop) == 0 {
 			conn, err := pgx.ConnectConfig(ctx, h.DbConnConfig)
 			if err != nil {
-				log.Fatalln(err)
+				h.setListenerState(false, err)
+
+				// equal jitter, half the backoff plus a random half, avoids reconnection storms of replicas after a failover
+				delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+				log.Printf("Listener reconnecting in %v.", delay)
+				time.Sleep(delay)
+
+				backoff *= 2
+				if backoff > listenerMaxBackoff {
+					backoff = listenerMaxBackoff
+				}
+
+				reconnecting = true
+				continue
 			}
 
-			channelId := pgx.Identifier{h.UpdatesChannelName}
+			backoff = listenerMinBackoff
+			h.setListenerState(true, nil)
+			h.channels.Reset()
 
-			// h.UpdatesChannelName is an identifier, not a string literal
-			if _, err := conn.Exec(ctx, fmt.Sprintf("listen %s", channelId.Sanitize())); err != nil {
-				log.Println(err)
-				conn.Close(ctx)
-			} else {
-				for {
-					waitContext, cancel := context.WithTimeout(ctx, time.Minute)
-					notification, err := conn.WaitForNotification(waitContext)
-					defer cancel()
+			if reconnecting {
+				log.Println("Listener reconnected, reloading routes.")
+				if err := h.createHandlers(); err != nil {
+					log.Println(err)
+				}
+				lastReload = time.Now()
+			}
+			reconnecting = true
 
-					if err != nil && waitContext.Err() == nil {
-						log.Println(err)
-						conn.Close(ctx)
-						break
+			var lost error
+
+			for atomic.LoadInt32(&h.stop) == 0 {
+				if err := h.channels.Sync(ctx, conn); err != nil {
+					lost = err
+					break
+				}
+
+				timeout := time.Minute
+				if h.ReloadIntervalSecs > 0 {
+					if untilReload := time.Until(lastReload.Add(time.Duration(h.ReloadIntervalSecs) * time.Second)); untilReload < timeout {
+						timeout = untilReload
 					}
-					if notification != nil && notification.Channel == h.UpdatesChannelName {
+				}
+
+				waitContext, cancel := h.channels.WaitContext(ctx, timeout)
+				notification, err := conn.WaitForNotification(waitContext)
+				timedOut := waitContext.Err() != nil
+				cancel()
+
+				if err != nil && !timedOut {
+					lost = err
+					break
+				}
+				if notification != nil {
+					if notification.Channel == h.UpdatesChannelName {
 						log.Println("Routes reload requested.")
 						if err := h.createHandlers(); err != nil {
 							log.Println(err)
 						}
+						lastReload = time.Now()
+					}
+
+					if notification.Channel == h.MaintenanceChannelName {
+						if err := h.reloadMaintenance(); err != nil {
+							log.Println(err)
+						}
+					}
+
+					if notification.Channel == h.ApiKeysChannelName {
+						if err := h.reloadApiKeys(); err != nil {
+							log.Println(err)
+						}
 					}
+
+					h.channels.Dispatch(notification)
 				}
+
+				if h.ReloadIntervalSecs > 0 && time.Since(lastReload) >= time.Duration(h.ReloadIntervalSecs)*time.Second {
+					if h.isVerbose() {
+						log.Println("Periodic routes reload.")
+					}
+					if err := h.createHandlers(); err != nil {
+						log.Println(err)
+					}
+					lastReload = time.Now()
+				}
+			}
+
+			conn.Close(ctx)
+
+			if lost != nil {
+				log.Println("Listener disconnected:", lost)
 			}
+			h.setListenerState(false, lost)
 		}
 	}()
 }
 
-// loads all routes from PostgreSQL and creates corresponding HTTP handlers, thread-safe
+// loads routes, and replaces handlers if successful, the result is recorded for status reports
+// unless in strict mode, invalid routes are skipped and reported
 func (h *RequestHandler) createHandlers() error {
+	loaded, routeErrors, err := h.loadHandlers()
+
+	for _, routeError := range routeErrors {
+		log.Println("Invalid route skipped:", routeError)
+	}
+	if err != nil {
+		log.Println("Routes reload failed, previous routes kept.")
+	}
+
+	h.recordReload(loaded, routeErrors, err)
+
+	return err
+}
+
+func (h *RequestHandler) loadHandlers() (int, []*RouteError, error) {
 	ctx := context.Background()
 	mux := denco.NewMux()
 
 	tx, err := h.db.Begin(ctx)
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
 	defer tx.Rollback(ctx)
 
-	routes, err := h.Schema.LoadRoutes(ctx, tx, h.SearchPath)
+	routes, routeErrors, err := h.Schema.LoadRoutes(ctx, tx, h.SearchPath)
 	if err != nil {
-		return err
+		return 0, routeErrors, err
 	}
 
-	handlers := make([]denco.Handler, 0, len(routes))
+	if err := h.loadMaintenance(ctx, tx); err != nil {
+		return 0, routeErrors, err
+	}
 
-	for _, r := range routes {
-		var jsonConstants *jason.Object
-		jsonConstants, err = jason.NewObjectFromBytes(r.RawConstants)
-		if err != nil {
-			return err
-		}
-		r.RawConstants = nil
+	if err := h.loadApiKeys(ctx, tx); err != nil {
+		return 0, routeErrors, err
+	}
 
-		r.Constants, err = prepareArgumentsFromObject(jsonConstants, r.ParametersTypes, nil)
-		if err != nil {
-			return err
+	if err := h.loadCertificateRoles(ctx, tx); err != nil {
+		return 0, routeErrors, err
+	}
+
+	handlers := make([]denco.Handler, 0, len(routes)+2)
+
+	// denco doesn't report which routes conflict
+	// paths only differing by names of variables conflict, e.g. /a/:x and /a/:y
+	paths := make(map[string]string)
+
+	if h.JobsUrlPath != "" {
+		statusHandler := h.makeJobStatusHandler()
+		cancelHandler := h.makeJobCancelHandler()
+
+		// jobs are checked like routes of the same methods
+		if h.MaintenanceTableName != "" {
+			statusHandler = h.makeMaintenanceHandler(&Route{Method: "get"}, statusHandler)
+			cancelHandler = h.makeMaintenanceHandler(&Route{Method: "delete"}, cancelHandler)
+		}
+		if h.CsrfMode != "" && h.CsrfMode != CsrfNone {
+			statusHandler = h.makeCsrfHandler(&Route{Method: "get"}, h.CsrfMode, statusHandler)
+			cancelHandler = h.makeCsrfHandler(&Route{Method: "delete"}, h.CsrfMode, cancelHandler)
 		}
 
-		if h.Verbose {
+		handlers = append(handlers,
+			mux.Handler("GET", h.JobsUrlPath+"/:job_id", statusHandler),
+			mux.Handler("DELETE", h.JobsUrlPath+"/:job_id", cancelHandler))
+		paths["GET "+routePattern(h.JobsUrlPath+"/:job_id")] = h.JobsUrlPath + "/:job_id"
+		paths["DELETE "+routePattern(h.JobsUrlPath+"/:job_id")] = h.JobsUrlPath + "/:job_id"
+	}
+
+	loadedRoutes := make([]*Route, 0, len(routes))
+
+	for _, r := range routes {
+		if h.isVerbose() {
 			log.Printf("Loading route, method: %s, url: %s, target: %s type: %s", r.Method, r.UrlPath, r.ObjectName, r.ObjectType)
 		}
 
-		var routeHandler denco.HandlerFunc = nil
+		routeHandler, err := h.makeRouteHandler(r)
 
-		switch r.ObjectType {
-		case "relation":
-			switch r.Method {
-			case "get", "delete":
-				routeHandler = h.makeNonBatchRouteHandler(r)
-			case "post", "put":
-				routeHandler = h.makeBatchRouteHandler(r)
-			default:
-				return errors.New("Unknown HTTP method " + r.Method)
+		key := strings.ToUpper(r.Method) + " " + routePattern(r.UrlPath)
+		if existing, ok := paths[key]; ok && err == nil {
+			if existing == r.UrlPath {
+				err = errors.New("Duplicate route.")
+			} else {
+				err = errors.New("Route conflicts with " + existing + ".")
 			}
-		case "procedure":
-			if r.Method == "get" && (r.Provolatile != 'i' && r.Provolatile != 's') {
-				return errors.New("Procedure '" + r.ObjectName + "' must be immutable or stable for use in GET routes.")
+		}
+
+		if err != nil {
+			routeError := &RouteError{Route: r, Err: err}
+			if h.Schema.StrictRoutes {
+				return 0, append(routeErrors, routeError), routeError
 			}
-			routeHandler = h.makeProcedureRouteHandler(r)
+
+			routeErrors = append(routeErrors, routeError)
+			continue
 		}
 
+		paths[key] = r.UrlPath
+		loadedRoutes = append(loadedRoutes, r)
 		handlers = append(handlers, mux.Handler(strings.ToUpper(r.Method), r.UrlPath, routeHandler))
 	}
 
 	handler, err := mux.Build(handlers)
 	if err != nil {
-		return err
+		return 0, routeErrors, err
 	}
 
 	handler = CatchingHandler(handler)
@@ -261,8 +569,131 @@ func (h *RequestHandler) createHandlers() error {
 	}
 
 	atomic.StorePointer(&h.handler, unsafe.Pointer(&handler))
+	h.routes.Store(loadedRoutes)
 
-	return nil
+	return len(loadedRoutes), routeErrors, nil
+}
+
+// returns the URL path without names of variables, e.g. /a/:/b/*
+func routePattern(urlPath string) string {
+	var pattern strings.Builder
+	variable := false
+
+	for _, c := range urlPath {
+		if c == '/' {
+			variable = false
+		} else if variable {
+			continue
+		} else if c == ':' || c == '*' {
+			variable = true
+		}
+		pattern.WriteRune(c)
+	}
+
+	return pattern.String()
+}
+
+// makes the request handler of a route, or reports why the route is invalid
+func (h *RequestHandler) makeRouteHandler(r *Route) (denco.HandlerFunc, error) {
+	jsonConstants, err := jason.NewObjectFromBytes(r.RawConstants)
+	if err != nil {
+		return nil, err
+	}
+	r.RawConstants = nil
+
+	r.Constants, err = prepareArgumentsFromObject(jsonConstants, r.ParametersTypes, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var routeHandler denco.HandlerFunc = nil
+
+	switch r.ObjectType {
+	case "relation":
+		switch r.Method {
+		case "get", "delete":
+			routeHandler = h.makeNonBatchRouteHandler(r)
+
+			if r.ContentColumn != "" {
+				if r.Method != "get" {
+					return nil, errors.New("Content column of relation '" + r.ObjectName + "' can only be used in GET routes.")
+				}
+				if err := checkRelationFileColumns(r); err != nil {
+					return nil, err
+				}
+				routeHandler = h.makeRelationFileHandler(r)
+			}
+		case "post", "put":
+			routeHandler = h.makeBatchRouteHandler(r)
+		default:
+			return nil, errors.New("Unknown HTTP method " + r.Method)
+		}
+
+		if r.Realtime {
+			if r.Method != "get" {
+				return nil, errors.New("Realtime relation '" + r.ObjectName + "' can only be used in GET routes.")
+			}
+			if h.changes == nil {
+				return nil, errors.New("Realtime relation '" + r.ObjectName + "' requires a replication slot.")
+			}
+			routeHandler = h.makeRealtimeRouteHandler(r, routeHandler)
+		}
+	case "procedure":
+		if r.Method == "get" && (r.Provolatile != 'i' && r.Provolatile != 's') {
+			return nil, errors.New("Procedure '" + r.ObjectName + "' must be immutable or stable for use in GET routes.")
+		}
+		if r.Async && h.JobsUrlPath == "" {
+			return nil, errors.New("Asynchronous procedure '" + r.ObjectName + "' requires a jobs URL path.")
+		}
+		if r.LargeObject {
+			if r.Async {
+				return nil, errors.New("Procedure '" + r.ObjectName + "' cannot stream large objects asynchronously.")
+			}
+
+			switch r.Method {
+			case "get":
+				if err := checkLargeObjectDownloadProc(r); err != nil {
+					return nil, err
+				}
+				routeHandler = h.makeLargeObjectDownloadHandler(r)
+			case "post", "put":
+				if _, err := findLargeObjectArgument(r); err != nil {
+					return nil, err
+				}
+				routeHandler = h.makeLargeObjectUploadHandler(r)
+			default:
+				return nil, errors.New("Large objects of procedure '" + r.ObjectName + "' cannot be used in " + strings.ToUpper(r.Method) + " routes.")
+			}
+		} else {
+			routeHandler = h.makeProcedureRouteHandler(r)
+		}
+	case "channel":
+		if r.Method != "get" {
+			return nil, errors.New("Channel '" + r.ObjectName + "' can only be used in GET routes.")
+		}
+		routeHandler = h.makeChannelRouteHandler(r)
+	}
+
+	if h.MaintenanceTableName != "" && !r.MaintenanceExempt {
+		routeHandler = h.makeMaintenanceHandler(r, routeHandler)
+	}
+
+	if err := checkCsrfMode(r.CsrfProtection); err != nil {
+		return nil, err
+	}
+	if mode := h.csrfMode(r); mode != "" && mode != CsrfNone {
+		routeHandler = h.makeCsrfHandler(r, mode, routeHandler)
+	}
+
+	if len(r.AllowedRoles) > 0 || len(r.RequiredScopes) > 0 {
+		routeHandler = h.makeAuthorizationHandler(r, routeHandler)
+	}
+
+	if h.ApiKeysTableName != "" {
+		routeHandler = h.makeApiKeyRoutesHandler(r, routeHandler)
+	}
+
+	return routeHandler, nil
 }
 
 // makes a request handler for non-batch routes on a relation (GETs and DELETEs)
@@ -277,6 +708,42 @@ func (h *RequestHandler) makeNonBatchRouteHandler(route *Route) denco.HandlerFun
 			panic(err)
 		}
 
+		columns, err := parseSelectedColumns(r, h.SelectQueryName, route)
+		if err != nil {
+			panic(err)
+		}
+
+		var page *Page
+		var aggregation *Aggregation
+		var embeddings []*Embedding
+		countMode := ""
+		if route.Method == "get" {
+			if embeddings, err = h.parseEmbeddings(r, h.EmbedQueryName, route); err != nil {
+				panic(err)
+			}
+			if aggregation, err = parseAggregation(r, h.GroupQueryName, h.AggregateQueryName, route); err != nil {
+				panic(err)
+			}
+			if page, err = parsePage(r, h.OffsetQueryName, h.CursorQueryName, route, order, aggregation == nil); err != nil {
+				panic(err)
+			}
+			if countMode, err = parseCountMode(r, h.CountQueryName); err != nil {
+				panic(err)
+			}
+		}
+
+		if aggregation != nil {
+			if err := aggregation.checkOrder(order); err != nil {
+				panic(err)
+			}
+			if countMode != "" || columns != route.SelectedColumns || len(embeddings) > 0 {
+				panic(aggregationError("Counts, selected columns, and embeddings can't be combined with aggregation."))
+			}
+			if route.MaxGroups > 0 && (limit <= 0 || limit > route.MaxGroups) {
+				limit = route.MaxGroups
+			}
+		}
+
 		responder, err := h.getResponder(r, h.MaxResponseSizeKbytes, route)
 		if err != nil {
 			panic(err)
@@ -294,15 +761,57 @@ func (h *RequestHandler) makeNonBatchRouteHandler(route *Route) denco.HandlerFun
 		}
 
 		context := makeContext(r, h.DefaultContext, params, route.ContextInputCookies, route.ContextParameters, route.ContextHeaders)
+		if err := h.mergeEmbeddingsContext(r, context, embeddings); err != nil {
+			panic(err)
+		}
 		if err := setTxContext(ctx, tx, h.StatementTimeoutSecs, clientCn, h.ContextParameterName, context); err != nil {
 			panic(err)
 		}
 
+		request := h.hookRequest(route, r)
+		if clientCn, err = h.preRequestHook(ctx, tx, request, clientCn); err != nil {
+			panic(err)
+		}
+
+		if err := h.embeddingsPreRequestHooks(ctx, tx, r, embeddings, clientCn); err != nil {
+			panic(err)
+		}
+
+		if err := checkEmbeddingsAuthorization(r, embeddings, clientCn); err != nil {
+			panic(err)
+		}
+
+		audit := h.newAuditEntry(route, r, clientCn, nil)
+
 		sql := NewSqlBuilder()
+		bounds := &PageBounds{}
+		count := int64(0)
 
 		switch route.Method {
 		case "get":
-			if err := buildSelectSqlQuery(&sql, h.FtsFunctionName, route.ParametersTypes, route.SelectedColumns, route.ObjectName, filter, order, limit); err != nil {
+			_, isJson := responder.(*JsonRecordSetWriter)
+			envelope := countMode != "" && h.CountEnvelope && isJson
+
+			if countMode != "" {
+				if count, err = h.countRecords(ctx, tx, route, filter, countMode); err != nil {
+					panic(err)
+				}
+			}
+
+			if envelope {
+				if err := beginCountEnvelope(responder, count); err != nil {
+					panic(err)
+				}
+			}
+
+			if aggregation != nil {
+				err = buildAggregateSqlQuery(&sql, h.FtsFunctionName, route.ParametersTypes, aggregation, route.ObjectName, filter, order, limit, page.Offset)
+			} else if page.Keyset {
+				err = buildKeysetSelectSqlQuery(&sql, h.FtsFunctionName, route.ParametersTypes, route.ParametersDeclTypes, columns, embeddings, route.ObjectName, filter, page, limit)
+			} else {
+				err = buildSelectSqlQuery(&sql, h.FtsFunctionName, route.ParametersTypes, columns, embeddings, route.ObjectName, filter, order, limit, page.Offset)
+			}
+			if err != nil {
 				panic(err)
 			}
 
@@ -313,9 +822,15 @@ func (h *RequestHandler) makeNonBatchRouteHandler(route *Route) denco.HandlerFun
 			}
 			defer rows.Close()
 
-			if err := readRecords(responder, false, rows); err != nil {
+			if err := readPageRecords(responder, false, rows, embeddings, page.Keyset, bounds); err != nil {
 				panic(err)
 			}
+
+			if envelope {
+				if err := endCountEnvelope(responder); err != nil {
+					panic(err)
+				}
+			}
 		case "delete":
 			if err := buildDeleteSqlQuery(&sql, h.FtsFunctionName, route.ParametersTypes, route.ObjectName, filter); err != nil {
 				panic(err)
@@ -327,6 +842,8 @@ func (h *RequestHandler) makeNonBatchRouteHandler(route *Route) denco.HandlerFun
 				panic(err)
 			}
 
+			audit.setRowsAffected(cmdTag.RowsAffected())
+
 			if err := VisitRowsAffectedRecordSet(responder, cmdTag.RowsAffected()); err != nil {
 				panic(err)
 			}
@@ -334,14 +851,36 @@ func (h *RequestHandler) makeNonBatchRouteHandler(route *Route) denco.HandlerFun
 			panic(errors.New("Unknown HTTP method: " + route.Method))
 		}
 
+		if err := h.postRequestHook(ctx, tx, request); err != nil {
+			panic(err)
+		}
+
+		if err := h.embeddingsPostRequestHooks(ctx, tx, embeddings); err != nil {
+			panic(err)
+		}
+
 		if err := setCookies(ctx, w, tx, h.ContextParameterName, route.ContextOutputCookies); err != nil {
 			panic(err)
 		}
 
+		if err := h.auditInTx(ctx, tx, audit); err != nil {
+			panic(err)
+		}
+
 		if err := tx.Commit(ctx); err != nil {
 			panic(err)
 		}
 
+		h.auditAfterCommit(audit)
+
+		if page != nil {
+			setPageLinks(w, r, h.OffsetQueryName, h.CursorQueryName, page, limit, bounds)
+		}
+		if countMode != "" {
+			setContentRange(w, page, bounds, count)
+		}
+		setEmbeddingsTruncated(w, bounds)
+
 		setCacheControl(w, route.TTL, route.IsPublic)
 		responder.HttpRespond(w)
 	}
@@ -364,6 +903,17 @@ func (h *RequestHandler) makeBatchRouteHandler(route *Route) denco.HandlerFunc {
 			panic(err)
 		}
 
+		columns, err := parseSelectedColumns(r, h.SelectQueryName, route)
+		if err != nil {
+			panic(err)
+		}
+
+		// updated records are only returned if columns are selected
+		returning := ""
+		if _, ok := r.URL.Query()[h.SelectQueryName]; ok && h.SelectQueryName != "" {
+			returning = columns
+		}
+
 		responder, err := h.getResponder(r, h.MaxResponseSizeKbytes, route)
 		if err != nil {
 			panic(err)
@@ -385,6 +935,13 @@ func (h *RequestHandler) makeBatchRouteHandler(route *Route) denco.HandlerFunc {
 			panic(err)
 		}
 
+		request := h.hookRequest(route, r)
+		if clientCn, err = h.preRequestHook(ctx, tx, request, clientCn); err != nil {
+			panic(err)
+		}
+
+		audit := h.newAuditEntry(route, r, clientCn, queries)
+
 		if batch {
 			responder.BeginBatch()
 		}
@@ -396,8 +953,10 @@ func (h *RequestHandler) makeBatchRouteHandler(route *Route) denco.HandlerFunc {
 			}
 
 			for _, query := range queries {
-				processPostQuery(ctx, h, route, tx, responder, query)
+				processPostQuery(ctx, h, route, tx, responder, columns, query)
 			}
+
+			audit.setRowsAffected(int64(len(queries)))
 		case "put":
 			if batch {
 				panic(errors.New("put requests on relations do not support batch mode."))
@@ -406,18 +965,35 @@ func (h *RequestHandler) makeBatchRouteHandler(route *Route) denco.HandlerFunc {
 
 				sql := NewSqlBuilder()
 
-				if err := buildUpdateSqlQuery(&sql, h.FtsFunctionName, route.ParametersTypes, route.ObjectName, filter, query); err != nil {
+				if err := buildUpdateSqlQuery(&sql, h.FtsFunctionName, route.ParametersTypes, returning, route.ObjectName, filter, query); err != nil {
 					panic(err)
 				}
 
-				cmdTag, err := tx.Exec(ctx, sql.Sql(), sql.Values()...)
-				if err != nil {
-					log.Println("While executing:", sql.Sql())
-					panic(err)
-				}
+				if returning != "" {
+					rows, err := tx.Query(ctx, sql.Sql(), sql.Values()...)
+					if err != nil {
+						log.Println("While executing:", sql.Sql())
+						panic(err)
+					}
+					defer rows.Close()
 
-				if err := VisitRowsAffectedRecordSet(responder, cmdTag.RowsAffected()); err != nil {
-					panic(err)
+					if err := readRecords(responder, false, rows); err != nil {
+						panic(err)
+					}
+
+					audit.setRowsAffected(rows.CommandTag().RowsAffected())
+				} else {
+					cmdTag, err := tx.Exec(ctx, sql.Sql(), sql.Values()...)
+					if err != nil {
+						log.Println("While executing:", sql.Sql())
+						panic(err)
+					}
+
+					audit.setRowsAffected(cmdTag.RowsAffected())
+
+					if err := VisitRowsAffectedRecordSet(responder, cmdTag.RowsAffected()); err != nil {
+						panic(err)
+					}
 				}
 			}
 		default:
@@ -428,24 +1004,34 @@ func (h *RequestHandler) makeBatchRouteHandler(route *Route) denco.HandlerFunc {
 			responder.EndBatch()
 		}
 
+		if err := h.postRequestHook(ctx, tx, request); err != nil {
+			panic(err)
+		}
+
 		if err := setCookies(ctx, w, tx, h.ContextParameterName, route.ContextOutputCookies); err != nil {
 			panic(err)
 		}
 
+		if err := h.auditInTx(ctx, tx, audit); err != nil {
+			panic(err)
+		}
+
 		if err := tx.Commit(ctx); err != nil {
 			panic(err)
 		}
 
+		h.auditAfterCommit(audit)
+
 		setCacheControl(w, route.TTL, route.IsPublic)
 		responder.HttpRespond(w)
 	}
 }
 
 // makes one SQL insert based on a POST request
-func processPostQuery(ctx context.Context, h *RequestHandler, route *Route, tx pgx.Tx, responder RecordSetHttpResponder, query map[string]interface{}) {
+func processPostQuery(ctx context.Context, h *RequestHandler, route *Route, tx pgx.Tx, responder RecordSetHttpResponder, columns string, query map[string]interface{}) {
 	sql := NewSqlBuilder()
 
-	if err := buildInsertSqlQuery(&sql, h.FtsFunctionName, route.ParametersTypes, route.SelectedColumns, route.ObjectName, query); err != nil {
+	if err := buildInsertSqlQuery(&sql, h.FtsFunctionName, route.ParametersTypes, columns, route.ObjectName, query); err != nil {
 		panic(err)
 	}
 
@@ -506,10 +1092,45 @@ func (h *RequestHandler) makeProcedureRouteHandler(route *Route) denco.HandlerFu
 		}
 
 		context := makeContext(r, h.DefaultContext, params, route.ContextInputCookies, route.ContextParameters, route.ContextHeaders)
+
+		request := h.hookRequest(route, r)
+
+		if route.Async {
+			if h.PreRequestProcedure != "" && request != nil {
+				// jobs are accepted by the pre-request procedure, in the request's transaction
+				if err := setTxContext(ctx, tx, h.StatementTimeoutSecs, clientCn, h.ContextParameterName, context); err != nil {
+					panic(err)
+				}
+				if clientCn, err = h.preRequestHook(ctx, tx, request, clientCn); err != nil {
+					panic(err)
+				}
+				// the job gets context variables changed by the pre-request procedure
+				if context, err = getTxContext(ctx, tx, h.ContextParameterName); err != nil {
+					panic(err)
+				}
+			}
+
+			// the procedure will run in its own transaction, once the client has been identified, and is audited there
+			audit := h.newAuditEntry(route, r, clientCn, queries)
+			job, err := h.submitJob(route, clientCn, context, queries, globalQuery, batch, responder, request, audit)
+			if err != nil {
+				panic(err)
+			}
+
+			h.respondJobAccepted(w, r, job)
+			return
+		}
+
 		if err := setTxContext(ctx, tx, h.StatementTimeoutSecs, clientCn, h.ContextParameterName, context); err != nil {
 			panic(err)
 		}
 
+		if clientCn, err = h.preRequestHook(ctx, tx, request, clientCn); err != nil {
+			panic(err)
+		}
+
+		audit := h.newAuditEntry(route, r, clientCn, queries)
+
 		if batch {
 			responder.BeginBatch()
 		}
@@ -526,14 +1147,24 @@ func (h *RequestHandler) makeProcedureRouteHandler(route *Route) denco.HandlerFu
 			responder.EndBatch()
 		}
 
+		if err := h.postRequestHook(ctx, tx, request); err != nil {
+			panic(err)
+		}
+
 		if err := setCookies(ctx, w, tx, h.ContextParameterName, route.ContextOutputCookies); err != nil {
 			panic(err)
 		}
 
+		if err := h.auditInTx(ctx, tx, audit); err != nil {
+			panic(err)
+		}
+
 		if err := tx.Commit(ctx); err != nil {
 			panic(err)
 		}
 
+		h.auditAfterCommit(audit)
+
 		setCacheControl(w, route.TTL, route.IsPublic)
 		responder.HttpRespond(w)
 	}
@@ -675,8 +1306,93 @@ func (h *RequestHandler) getResponder(r *http.Request, maxResponseSizeKbytes int
 	return &BinRecordSetWriter{MaxResponseSizeBytes: maxResponseSizeKbytes << 10, ContentType: mimeType}, nil
 }
 
+// RequestTx is the transaction of a request, with the role and context of the client set
+type RequestTx struct {
+	pgx.Tx
+	Route   *Route
+	Role    string
+	Context map[string]string
+	Request []byte      // argument of hook procedures, nil if hooks are disabled for the route
+	Audit   *AuditEntry // nil if the request isn't audited
+}
+
+// begins the transaction of a request to a route, once the client is identified, its context set, and the pre-request procedure called
+func (h *RequestHandler) beginRequestTx(ctx context.Context, r *http.Request, route *Route, params denco.Params) (*RequestTx, error) {
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rtx := &RequestTx{
+		Tx:      tx,
+		Route:   route,
+		Context: makeContext(r, h.DefaultContext, params, route.ContextInputCookies, route.ContextParameters, route.ContextHeaders),
+	}
+
+	if rtx.Role, err = getClientRole(ctx, tx, r, h.DefaultCn); err != nil {
+		tx.Rollback(ctx)
+		return nil, err
+	}
+
+	if err := setTxContext(ctx, tx, h.StatementTimeoutSecs, rtx.Role, h.ContextParameterName, rtx.Context); err != nil {
+		tx.Rollback(ctx)
+		return nil, err
+	}
+
+	rtx.Request = h.hookRequest(route, r)
+	if rtx.Role, err = h.preRequestHook(ctx, tx, rtx.Request, rtx.Role); err != nil {
+		tx.Rollback(ctx)
+		return nil, err
+	}
+
+	// handlers of routes with arguments replace the entry
+	rtx.Audit = h.newAuditEntry(route, r, rtx.Role, nil)
+
+	return rtx, nil
+}
+
+// calls the post-request procedure, sets cookies of the route from context variables, and commits the transaction of a request
+// the request is audited in the transaction, or once committed
+func (h *RequestHandler) commitRequestTx(ctx context.Context, w http.ResponseWriter, tx *RequestTx) error {
+	if err := h.postRequestHook(ctx, tx, tx.Request); err != nil {
+		return err
+	}
+
+	if err := setCookies(ctx, w, tx, h.ContextParameterName, tx.Route.ContextOutputCookies); err != nil {
+		return err
+	}
+
+	if err := h.auditInTx(ctx, tx, tx.Audit); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	h.auditAfterCommit(tx.Audit)
+
+	return nil
+}
+
+// Querier runs queries within a transaction, or on a connection of the pool
+type Querier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// errors of credentials sent by clients, as opposed to errors of the database
+var (
+	errUnencryptedAuthorization = errors.New("Authorization denied over unencrypted connections.")
+	errIncorrectCredentials     = errors.New("Incorrect credentials.")
+)
+
 // checks TLS common name against configured CA or HTTP Basic authentication as a database user
-func getClientRole(ctx context.Context, tx pgx.Tx, r *http.Request, defaultCn string) (string, error) {
+func getClientRole(ctx context.Context, db Querier, r *http.Request, defaultCn string) (string, error) {
+	if identity := requestTokenIdentity(r); identity != nil {
+		// bearer tokens were verified before routing
+		return identity.Role, nil
+	}
+
 	if defaultCn == "" {
 		// if defaultCn is not specified, we don't active impersonalisation
 		return "", nil
@@ -688,7 +1404,7 @@ func getClientRole(ctx context.Context, tx pgx.Tx, r *http.Request, defaultCn st
 
 	if h, ok := r.Header["Authorization"]; ok {
 		if r.TLS == nil {
-			return "", errors.New("Authorization denied over unencrypted connections.")
+			return "", errUnencryptedAuthorization
 		}
 
 		parts := strings.SplitN(h[0], " ", 2)
@@ -699,7 +1415,7 @@ func getClientRole(ctx context.Context, tx pgx.Tx, r *http.Request, defaultCn st
 					usr := parts[0]
 					pwd := parts[1]
 
-					if err := checkDbRole(ctx, tx, usr, pwd); err != nil {
+					if err := checkDbRole(ctx, db, usr, pwd); err != nil {
 						return "", err
 					}
 
@@ -713,22 +1429,22 @@ func getClientRole(ctx context.Context, tx pgx.Tx, r *http.Request, defaultCn st
 }
 
 // checks username/passward against PostgreSQL
-func checkDbRole(ctx context.Context, tx pgx.Tx, role string, password string) error {
-	builder := NewSqlBuilder()
+func checkDbRole(ctx context.Context, db Querier, role string, password string) error {
+	var verifier pgtype.Text
 
-	builder.WriteSql("SELECT true FROM pg_authid WHERE (rolvaliduntil > now() OR rolvaliduntil IS NULL) AND rolname=")
-	builder.WriteValue(role)
-	builder.WriteSql(" AND CASE WHEN substr(rolpassword, 1, 3) = 'md5' THEN rolpassword = 'md5' || encode(digest(")
-	builder.WriteValue(password)
-	builder.WriteSql(" || ")
+	builder := NewSqlBuilder()
+	builder.WriteSql("SELECT rolpassword FROM pg_authid WHERE (rolvaliduntil > now() OR rolvaliduntil IS NULL) AND rolname=")
 	builder.WriteValue(role)
-	builder.WriteSql(", 'md5'), 'hex') ELSE FALSE END")
 
-	if tag, err := tx.Exec(ctx, builder.Sql(), builder.Values()...); err != nil {
+	if err := db.QueryRow(ctx, builder.Sql(), builder.Values()...).Scan(&verifier); err == pgx.ErrNoRows {
+		return errIncorrectCredentials
+	} else if err != nil {
 		log.Println("While executing:", builder.Sql())
 		return err
-	} else if tag.RowsAffected() == 0 {
-		return errors.New("Incorrect credentials.")
+	}
+
+	if verifier.Status != pgtype.Present || !verifiedCredentials.Check(role, password, verifier.String) {
+		return errIncorrectCredentials
 	}
 
 	return nil
@@ -751,7 +1467,7 @@ func parseQueryString(r *http.Request, globalQuery map[string]interface{}, filte
 
 	if globalQuery != nil {
 		for k, v := range globalQuery {
-			equalityTerm := queryme.Eq{queryme.Field(k), []queryme.Value{v}}
+			equalityTerm := queryme.Eq{Field: queryme.Field(k), Operands: []queryme.Value{v}}
 			conjunctionTerms = append(conjunctionTerms, equalityTerm)
 		}
 	}
@@ -786,6 +1502,45 @@ func parseQueryString(r *http.Request, globalQuery map[string]interface{}, filte
 	return filter, order, limit, nil
 }
 
+// returns columns requested in the query string as comma-separated list, e.g. name,total:amount where total is an alias
+// all columns of the route are returned if not requested
+func parseSelectedColumns(r *http.Request, selectQueryName string, route *Route) (string, error) {
+	if selectQueryName == "" {
+		return route.SelectedColumns, nil
+	}
+
+	values, ok := r.URL.Query()[selectQueryName]
+	if !ok {
+		return route.SelectedColumns, nil
+	}
+
+	columns := make([]string, 0, 8)
+
+	for _, item := range strings.Split(values[0], ",") {
+		alias := ""
+		name := strings.TrimSpace(item)
+		if i := strings.IndexRune(name, ':'); i >= 0 {
+			alias = strings.TrimSpace(name[:i])
+			name = strings.TrimSpace(name[i+1:])
+		}
+
+		if _, ok := route.ParametersTypes[name]; !ok {
+			return "", errors.New("Unknown column " + name + ".")
+		}
+		if _, ok := route.HiddenFields[name]; ok {
+			return "", errors.New("Unknown column " + name + ".")
+		}
+
+		column := quoteIdentifier(name)
+		if alias != "" && alias != name {
+			column += " AS " + quoteIdentifier(alias)
+		}
+		columns = append(columns, column)
+	}
+
+	return strings.Join(columns, ","), nil
+}
+
 // compute variables of context based on HTTP request
 func makeContext(r *http.Request, defaultContext map[string]string, params denco.Params, contextInputCookies map[string]*CookieConfig, contextParameters []string, contextHeaders pgtype.Hstore) map[string]string {
 	context := make(map[string]string)
@@ -819,6 +1574,17 @@ func makeContext(r *http.Request, defaultContext map[string]string, params denco
 		}
 	}
 
+	if token, ok := r.Context().Value(csrfTokenKey{}).(*csrfToken); ok {
+		context[token.Variable] = token.Value
+	}
+
+	// claims of verified tokens can't be overridden by the client
+	if identity := requestTokenIdentity(r); identity != nil {
+		for k, v := range identity.Context {
+			context[k] = v
+		}
+	}
+
 	return context
 }
 
@@ -874,6 +1640,30 @@ func setTxContext(ctx context.Context, tx pgx.Tx, statementTimeout int, role str
 	return nil
 }
 
+// reads context variables of the transaction, e.g. once changed by the pre-request procedure
+func getTxContext(ctx context.Context, tx pgx.Tx, sessionParameter string) (map[string]string, error) {
+	prefix := sessionParameter + "."
+
+	rows, err := tx.Query(ctx, `SELECT name, current_setting(name) FROM pg_settings WHERE left(name, length($1)) = $1`, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	context := make(map[string]string)
+
+	for rows.Next() {
+		var name, setting string
+		if err := rows.Scan(&name, &setting); err != nil {
+			return nil, err
+		}
+
+		context[name[len(prefix):]] = setting
+	}
+
+	return context, rows.Err()
+}
+
 // set cookies in HTTP response
 func setCookies(ctx context.Context, w http.ResponseWriter, tx pgx.Tx, sessionParameter string, contextOutputCookies []*CookieConfig) error {
 	sessionParameterLen := len(sessionParameter) + 1
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseSelectedColumns(t *testing.T) {
+	route := &Route{
+		ParametersTypes: map[string]ArgumentType{"id": {}, "name": {}, "amount": {}, "password": {}},
+		HiddenFields:    map[string]struct{}{"password": {}},
+		SelectedColumns: `"id","name","amount"`,
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		columns string // empty if the request must be refused
+	}{
+		{"all columns", "", `"id","name","amount"`},
+		{"one column", "select=name", `"name"`},
+		{"ordered", "select=amount,id", `"amount","id"`},
+		{"alias", "select=" + url.QueryEscape("total:amount"), `"amount" AS "total"`},
+		{"alias with spaces", "select=" + url.QueryEscape(" total : amount , id"), `"amount" AS "total","id"`},
+		{"alias of the same name", "select=" + url.QueryEscape("id:id"), `"id"`},
+		{"quoted alias", "select=" + url.QueryEscape(`a"b:id`), `"id" AS "a""b"`},
+		{"unknown column", "select=missing", ""},
+		{"hidden column", "select=password", ""},
+		{"aliased hidden column", "select=" + url.QueryEscape("p:password"), ""},
+		{"empty", "select=", ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/?"+test.query, nil)
+
+		columns, err := parseSelectedColumns(r, "select", route)
+
+		if test.columns == "" {
+			if err == nil {
+				t.Errorf("%s: columns %s accepted", test.name, columns)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if columns != test.columns {
+			t.Errorf("%s: %s expected, got %s", test.name, test.columns, columns)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/?select=name", nil)
+	if columns, _ := parseSelectedColumns(r, "", route); columns != route.SelectedColumns {
+		t.Errorf("columns selected while disabled: %s", columns)
+	}
+}
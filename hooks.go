@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// describes the request to hook procedures, as argument named request, nil if hooks are disabled for the route
+func (h *RequestHandler) hookRequest(route *Route, r *http.Request) []byte {
+	if (h.PreRequestProcedure == "" && h.PostRequestProcedure == "") || route.HooksExempt {
+		return nil
+	}
+
+	// only headers and cookies configured for the route are passed, like for the context, so credentials aren't leaked
+	headers := make(map[string]string, len(route.ContextHeaders.Map))
+	for name := range route.ContextHeaders.Map {
+		if values, ok := r.Header[name]; ok {
+			headers[name] = values[0]
+		}
+	}
+
+	cookies := make(map[string]string, len(route.ContextInputCookies))
+	for _, cookie := range r.Cookies() {
+		if _, ok := route.ContextInputCookies[cookie.Name]; ok {
+			cookies[cookie.Name] = cookie.Value
+		}
+	}
+
+	request, _ := json.Marshal(map[string]interface{}{
+		"route_id": route.RouteID,
+		"method":   route.Method,
+		"url_path": route.UrlPath,
+		"path":     r.URL.Path,
+		"query":    r.URL.RawQuery,
+		"headers":  headers,
+		"cookies":  cookies,
+	})
+
+	return request
+}
+
+// calls the pre-request procedure, after the context of the transaction is set and before the route's query
+// the procedure can raise an exception to reject the request, or return a role replacing the client's one
+func (h *RequestHandler) preRequestHook(ctx context.Context, tx pgx.Tx, request []byte, role string) (string, error) {
+	if h.PreRequestProcedure == "" || request == nil {
+		return role, nil
+	}
+
+	sql := NewSqlBuilder()
+	if err := buildProcedureSqlQuery(&sql, h.PreRequestProcedure, false, false, map[string]interface{}{"request": string(request)}); err != nil {
+		return "", err
+	}
+
+	var newRole pgtype.Text
+	if err := tx.QueryRow(ctx, sql.Sql(), sql.Values()...).Scan(&newRole); err != nil {
+		log.Println("While executing:", sql.Sql())
+		return "", hookError(err)
+	}
+
+	if newRole.Status != pgtype.Present || newRole.String == "" || newRole.String == role {
+		return role, nil
+	}
+
+	if _, err := tx.Exec(ctx, "SET LOCAL ROLE E"+quoteWith(newRole.String, '\'', true)); err != nil {
+		return "", err
+	}
+
+	return newRole.String, nil
+}
+
+// calls the post-request procedure, after the route's query and before commit
+func (h *RequestHandler) postRequestHook(ctx context.Context, tx pgx.Tx, request []byte) error {
+	if h.PostRequestProcedure == "" || request == nil {
+		return nil
+	}
+
+	sql := NewSqlBuilder()
+	if err := buildProcedureSqlQuery(&sql, h.PostRequestProcedure, false, false, map[string]interface{}{"request": string(request)}); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, sql.Sql(), sql.Values()...); err != nil {
+		log.Println("While executing:", sql.Sql())
+		return hookError(err)
+	}
+
+	return nil
+}
+
+// maps exceptions raised by hooks to HTTP status codes
+// SQLSTATE PTxxx is answered with status xxx, 28000 and 28P01 with 401, 42501 with 403
+func hookError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	status := 0
+	switch {
+	case strings.HasPrefix(pgErr.Code, "PT"):
+		if s, err := strconv.Atoi(pgErr.Code[2:]); err == nil && s >= 400 && s < 600 {
+			status = s
+		}
+	case pgErr.Code == "28000" || pgErr.Code == "28P01":
+		status = http.StatusUnauthorized
+	case pgErr.Code == "42501":
+		status = http.StatusForbidden
+	}
+
+	if status == 0 {
+		return err
+	}
+
+	return &HttpError{Status: status, Err: errors.New(pgErr.Message)}
+}
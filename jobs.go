@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/naoina/denco"
+)
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is a procedure call executed in background, its result is kept until fetched or expired
+type Job struct {
+	ID       string
+	Secret   string // required to access the job, only known by its submitter
+	Role     string
+	Status   string
+	Error    string
+	Finished time.Time
+
+	header    http.Header // cookies set by the procedure
+	route     *Route
+	responder RecordSetHttpResponder
+	cancel    context.CancelFunc
+}
+
+// JobStore keeps track of background jobs in memory, and limits how many run concurrently
+type JobStore struct {
+	mutex     sync.Mutex
+	jobs      map[string]*Job
+	slots     chan struct{}
+	retention time.Duration
+}
+
+func NewJobStore(maxConcurrentJobs int, retentionSecs int) *JobStore {
+	if maxConcurrentJobs <= 0 {
+		maxConcurrentJobs = 1
+	}
+
+	return &JobStore{
+		jobs:      make(map[string]*Job),
+		slots:     make(chan struct{}, maxConcurrentJobs),
+		retention: time.Duration(retentionSecs) * time.Second,
+	}
+}
+
+// registers a new pending job
+func (store *JobStore) Add(role string, cancel context.CancelFunc) (*Job, error) {
+	var id, secret [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		ID:     fmt.Sprintf("%x", id),
+		Secret: fmt.Sprintf("%x", secret),
+		Role:   role,
+		Status: JobPending,
+		header: make(http.Header),
+		cancel: cancel,
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.jobs[job.ID] = job
+
+	return job, nil
+}
+
+// forgets jobs finished for longer than the retention delay, periodically
+func (store *JobStore) ExpireFinished() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		store.mutex.Lock()
+		for id, job := range store.jobs {
+			if !job.Finished.IsZero() && now.Sub(job.Finished) > store.retention {
+				delete(store.jobs, id)
+			}
+		}
+		store.mutex.Unlock()
+	}
+}
+
+// returns a copy of the job, safe to read, if the secret matches
+func (store *JobStore) Get(id string, secret string) (Job, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if job, ok := store.jobs[id]; ok && subtle.ConstantTimeCompare([]byte(job.Secret), []byte(secret)) == 1 {
+		return *job, true
+	}
+
+	return Job{}, false
+}
+
+// cancels and forgets a job, if the secret matches
+func (store *JobStore) Remove(id string, secret string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	job, ok := store.jobs[id]
+	if ok && subtle.ConstantTimeCompare([]byte(job.Secret), []byte(secret)) == 1 {
+		job.cancel()
+		delete(store.jobs, id)
+		return true
+	}
+
+	return false
+}
+
+func (store *JobStore) setStatus(job *Job, status string, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	job.Status = status
+	if err != nil {
+		// errors are reported to clients the same way as for requests processed right away
+		job.Error = clientErrorMessage(err)
+		if job.Error == "" {
+			job.Error = "Job failed."
+		}
+	}
+	if status == JobDone || status == JobFailed {
+		job.Finished = time.Now()
+	}
+}
+
+// runs procedure calls in background, using their own transaction, after a slot is available
+func (h *RequestHandler) submitJob(route *Route, role string, context map[string]string, queries []map[string]interface{}, globalQuery map[string]interface{}, batch bool, responder RecordSetHttpResponder, request []byte, audit *AuditEntry) (*Job, error) {
+	ctx, cancel := contextWithoutDeadline()
+
+	job, err := h.jobs.Add(role, cancel)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	job.route = route
+	job.responder = responder
+
+	go func() {
+		defer cancel()
+
+		select {
+		case h.jobs.slots <- struct{}{}:
+			defer func() { <-h.jobs.slots }()
+		case <-ctx.Done():
+			return
+		}
+
+		h.jobs.setStatus(job, JobRunning, nil)
+
+		if err := h.runJob(ctx, job, route, role, context, queries, globalQuery, batch, request, audit); err != nil {
+			log.Println("Error while processing job:", err)
+			h.jobs.setStatus(job, JobFailed, err)
+		} else {
+			h.jobs.setStatus(job, JobDone, nil)
+		}
+	}()
+
+	return job, nil
+}
+
+func (h *RequestHandler) runJob(ctx context.Context, job *Job, route *Route, role string, context map[string]string, queries []map[string]interface{}, globalQuery map[string]interface{}, batch bool, request []byte, audit *AuditEntry) (err error) {
+	// procedures are executed by functions reporting errors by panicking
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	dbTx, err := h.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback(ctx)
+
+	if err := setTxContext(ctx, dbTx, h.JobStatementTimeoutSecs, role, h.ContextParameterName, context); err != nil {
+		return err
+	}
+
+	tx := &RequestTx{Tx: dbTx, Route: route, Role: role, Context: context, Request: request, Audit: audit}
+
+	responder := job.responder
+
+	if batch {
+		responder.BeginBatch()
+	}
+
+	for _, query := range queries {
+		for k, v := range globalQuery {
+			query[k] = v
+		}
+
+		processProcedureQuery(ctx, route, tx, responder, query)
+	}
+
+	if batch {
+		responder.EndBatch()
+	}
+
+	return h.commitRequestTx(ctx, &headerRecorder{job.header}, tx)
+}
+
+// answers an accepted job with the URL where its status and result will be available
+func (h *RequestHandler) respondJobAccepted(w http.ResponseWriter, r *http.Request, job *Job) {
+	url := h.UrlPrefix + h.JobsUrlPath + "/" + job.ID + "." + r.Header.Get("X-Accept-Extension") + "?secret=" + job.Secret
+
+	body, _ := json.Marshal(map[string]string{
+		"id":     job.ID,
+		"status": JobPending,
+		"url":    url,
+	})
+
+	w.Header().Set("Location", url)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(body)
+}
+
+// makes a request handler returning the status of a job, or its result when done
+func (h *RequestHandler) makeJobStatusHandler() denco.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		job, ok := h.jobs.Get(params.Get("job_id"), r.URL.Query().Get("secret"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Unknown job."))
+			return
+		}
+
+		if !h.authorizeJob(w, r, params, &job) {
+			return
+		}
+
+		w.Header().Set("Cache-Control", "private, no-store")
+
+		if job.Status == JobDone {
+			for name, values := range job.header {
+				w.Header()[name] = values
+			}
+
+			job.responder.HttpRespond(w)
+			return
+		}
+
+		status := http.StatusAccepted
+		if job.Status == JobFailed {
+			status = http.StatusInternalServerError
+		}
+
+		response := map[string]string{
+			"id":     job.ID,
+			"status": job.Status,
+		}
+		if job.Error != "" {
+			response["error"] = job.Error
+		}
+
+		body, _ := json.Marshal(response)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+}
+
+// makes a request handler cancelling a job, and forgetting its result
+func (h *RequestHandler) makeJobCancelHandler() denco.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		id := params.Get("job_id")
+		secret := r.URL.Query().Get("secret")
+
+		job, ok := h.jobs.Get(id, secret)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Unknown job."))
+			return
+		}
+
+		if !h.authorizeJob(w, r, params, &job) {
+			return
+		}
+
+		if !h.jobs.Remove(id, secret) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Unknown job."))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// checks the client is authorized on the route which submitted the job, like requests to the route itself
+// failures are answered, and false is returned
+func (h *RequestHandler) authorizeJob(w http.ResponseWriter, r *http.Request, params denco.Params, job *Job) bool {
+	authorized := false
+	check := denco.HandlerFunc(func(http.ResponseWriter, *http.Request, denco.Params) {
+		authorized = true
+	})
+
+	if len(job.route.AllowedRoles) > 0 || len(job.route.RequiredScopes) > 0 {
+		check = h.makeAuthorizationHandler(job.route, check)
+	}
+	if h.ApiKeysTableName != "" {
+		check = h.makeApiKeyRoutesHandler(job.route, check)
+	}
+
+	check(w, r, params)
+
+	return authorized
+}
+
+// jobs outlive requests which submitted them
+func contextWithoutDeadline() (context.Context, context.CancelFunc) {
+	return context.WithCancel(context.Background())
+}
+
+// collects headers written by functions expecting an HTTP response
+type headerRecorder struct {
+	header http.Header
+}
+
+func (r *headerRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *headerRecorder) Write(b []byte) (int, error) {
+	return 0, errors.New("Body not supported.")
+}
+
+func (r *headerRecorder) WriteHeader(statusCode int) {
+}
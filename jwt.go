@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JwtVerifier checks signatures and registered claims of JSON Web Tokens
+// keys are either a shared secret for HS256, or read from a JWKS file, re-read periodically
+type JwtVerifier struct {
+	Secret         []byte
+	JwksPath       string
+	JwksReloadSecs int
+	Audience       string
+	Issuer         string
+	LeewaySecs     int
+	AllowNoExp     bool // tokens without exp claim never expire
+
+	mutex sync.RWMutex
+	keys  map[string]interface{} // by key ID, []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// identity of a client authenticated by a token or an API key, stored in the request's context
+type TokenIdentity struct {
+	Role    string
+	Context map[string]string
+	Routes  map[int]struct{} // IDs of routes allowed, all routes if empty
+	Scopes  []string
+}
+
+func (identity *TokenIdentity) HasScope(scope string) bool {
+	for _, s := range identity.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+type tokenIdentityKey struct{}
+
+// returns the identity attached to the request, if any
+func requestTokenIdentity(r *http.Request) *TokenIdentity {
+	identity, _ := r.Context().Value(tokenIdentityKey{}).(*TokenIdentity)
+	return identity
+}
+
+// verifies the token, and returns its claims
+func (v *JwtVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token.")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Malformed token signature.")
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyJwtSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// checks exp, nbf, aud and iss claims
+func (v *JwtVerifier) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	leeway := time.Duration(v.LeewaySecs) * time.Second
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.Add(-leeway).After(time.Unix(int64(exp), 0)) {
+			return errors.New("Token expired.")
+		}
+	} else if _, ok := claims["exp"]; ok {
+		return errors.New("Invalid exp claim.")
+	} else if !v.AllowNoExp {
+		return errors.New("Token without exp claim.")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+			return errors.New("Token not valid yet.")
+		}
+	} else if _, ok := claims["nbf"]; ok {
+		return errors.New("Invalid nbf claim.")
+	}
+
+	if v.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.Issuer {
+			return errors.New("Invalid token issuer.")
+		}
+	}
+
+	if v.Audience != "" {
+		found := false
+
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == v.Audience
+		case []interface{}:
+			for _, a := range aud {
+				if s, ok := a.(string); ok && s == v.Audience {
+					found = true
+				}
+			}
+		}
+
+		if !found {
+			return errors.New("Invalid token audience.")
+		}
+	}
+
+	return nil
+}
+
+// reads keys of the JWKS file, if any
+func (v *JwtVerifier) LoadKeys() error {
+	if v.JwksPath == "" {
+		return nil
+	}
+
+	keys, err := loadJwks(v.JwksPath)
+	if err != nil {
+		return err
+	}
+
+	v.mutex.Lock()
+	v.keys = keys
+	v.mutex.Unlock()
+
+	return nil
+}
+
+// re-reads keys of the JWKS file periodically, previous keys remain valid if the file can't be read
+func (v *JwtVerifier) ReloadKeys() {
+	if v.JwksPath == "" || v.JwksReloadSecs <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(v.JwksReloadSecs) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := v.LoadKeys(); err != nil {
+			log.Println("Cannot load JWKS file:", err)
+		}
+	}
+}
+
+// returns the key used to sign tokens, by ID if several are available
+func (v *JwtVerifier) key(kid string) (interface{}, error) {
+	if v.JwksPath == "" {
+		return v.Secret, nil
+	}
+
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+
+	// tokens may omit the key ID if there is a single key
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, nil
+		}
+	}
+
+	return nil, errors.New("Unknown token key.")
+}
+
+func verifyJwtSignature(alg string, key interface{}, signed []byte, signature []byte) error {
+	digest := sha256.Sum256(signed)
+
+	switch alg {
+	case "HS256":
+		if secret, ok := key.([]byte); ok && len(secret) > 0 {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(signed)
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return nil
+			}
+		}
+	case "RS256":
+		if publicKey, ok := key.(*rsa.PublicKey); ok {
+			if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		}
+	case "ES256":
+		if publicKey, ok := key.(*ecdsa.PublicKey); ok && len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(publicKey, digest[:], r, s) {
+				return nil
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported token algorithm %q.", alg)
+	}
+
+	return errors.New("Invalid token signature.")
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("Malformed token.")
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		return errors.New("Malformed token.")
+	}
+
+	return nil
+}
+
+// reads RSA, P-256 and symmetric keys of a JSON Web Key Set
+func loadJwks(path string) (map[string]interface{}, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+
+	if err := json.Unmarshal(raw, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch jwk.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("Invalid RSA key %q.", jwk.Kid)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("Invalid EC key %q.", jwk.Kid)
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		case "oct":
+			k, err := base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid symmetric key %q.", jwk.Kid)
+			}
+			keys[jwk.Kid] = k
+		}
+	}
+
+	return keys, nil
+}
+
+// authenticates bearer tokens, the identity is attached to the returned request
+// invalid tokens are answered with a 401 status code, and a nil request is returned
+func (h *RequestHandler) authenticateBearer(w http.ResponseWriter, r *http.Request) *http.Request {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return r
+	}
+
+	identity, err := h.verifyBearer(r, parts[1])
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="pgasus", error="invalid_token", error_description=%q`, err.Error()))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return nil
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), tokenIdentityKey{}, identity))
+}
+
+func (h *RequestHandler) verifyBearer(r *http.Request, token string) (*TokenIdentity, error) {
+	if r.TLS == nil {
+		return nil, errors.New("Authorization denied over unencrypted connections.")
+	}
+
+	claims, err := h.jwt.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &TokenIdentity{
+		Context: make(map[string]string),
+	}
+
+	role, _ := claims[h.JwtRoleClaim].(string)
+	if role == "" {
+		return nil, errors.New("Role claim missing.")
+	}
+	identity.Role = role
+	identity.Scopes = jwtScopes(claims)
+
+	for claim, variable := range h.JwtContextClaims {
+		switch value := claims[claim].(type) {
+		case nil:
+		case string:
+			identity.Context[variable] = value
+		default:
+			raw, _ := json.Marshal(value)
+			identity.Context[variable] = string(raw)
+		}
+	}
+
+	if h.JwtClaimsVariable != "" {
+		raw, _ := json.Marshal(claims)
+		identity.Context[h.JwtClaimsVariable] = string(raw)
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func signJwt(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJwtSignatures(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherEcKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := &JwtVerifier{
+		JwksPath: "jwks.json",
+		keys: map[string]interface{}{
+			"rsa": &rsaKey.PublicKey,
+			"ec":  &ecKey.PublicKey,
+			"oct": []byte("shared"),
+		},
+	}
+	secret := &JwtVerifier{Secret: []byte("secret")}
+
+	claims := map[string]interface{}{"role": "alice", "exp": float64(time.Now().Add(time.Hour).Unix())}
+
+	tests := []struct {
+		name     string
+		verifier *JwtVerifier
+		token    string
+		valid    bool
+	}{
+		{"HS256 secret", secret, signJwt(t, "HS256", "", []byte("secret"), claims), true},
+		{"HS256 wrong secret", secret, signJwt(t, "HS256", "", []byte("other"), claims), false},
+		{"RS256", jwks, signJwt(t, "RS256", "rsa", rsaKey, claims), true},
+		{"ES256", jwks, signJwt(t, "ES256", "ec", ecKey, claims), true},
+		{"ES256 other key", jwks, signJwt(t, "ES256", "ec", otherEcKey, claims), false},
+		{"HS256 from JWKS", jwks, signJwt(t, "HS256", "oct", []byte("shared"), claims), true},
+		{"algorithm not matching key", jwks, signJwt(t, "HS256", "rsa", []byte("shared"), claims), false},
+		{"unknown key", jwks, signJwt(t, "RS256", "other", rsaKey, claims), false},
+		{"none algorithm", secret, signJwt(t, "none", "", nil, claims), false},
+		{"HS256 secret on RS256 token", secret, signJwt(t, "RS256", "", rsaKey, claims), false},
+		{"malformed", secret, "abc.def", false},
+	}
+
+	for _, test := range tests {
+		_, err := test.verifier.Verify(test.token)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: valid %v expected, got error %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestJwtClaims(t *testing.T) {
+	now := time.Now()
+	hour := float64(now.Add(time.Hour).Unix())
+	hourAgo := float64(now.Add(-time.Hour).Unix())
+
+	tests := []struct {
+		name     string
+		verifier *JwtVerifier
+		claims   map[string]interface{}
+		valid    bool
+	}{
+		{"valid", &JwtVerifier{}, map[string]interface{}{"exp": hour}, true},
+		{"expired", &JwtVerifier{}, map[string]interface{}{"exp": hourAgo}, false},
+		{"expired within leeway", &JwtVerifier{LeewaySecs: 7200}, map[string]interface{}{"exp": hourAgo}, true},
+		{"invalid exp", &JwtVerifier{}, map[string]interface{}{"exp": "tomorrow"}, false},
+		{"missing exp", &JwtVerifier{}, map[string]interface{}{}, false},
+		{"missing exp allowed", &JwtVerifier{AllowNoExp: true}, map[string]interface{}{}, true},
+		{"not valid yet", &JwtVerifier{}, map[string]interface{}{"exp": hour, "nbf": hour}, false},
+		{"valid since", &JwtVerifier{}, map[string]interface{}{"exp": hour, "nbf": hourAgo}, true},
+		{"issuer", &JwtVerifier{Issuer: "auth"}, map[string]interface{}{"exp": hour, "iss": "auth"}, true},
+		{"wrong issuer", &JwtVerifier{Issuer: "auth"}, map[string]interface{}{"exp": hour, "iss": "other"}, false},
+		{"missing issuer", &JwtVerifier{Issuer: "auth"}, map[string]interface{}{"exp": hour}, false},
+		{"audience", &JwtVerifier{Audience: "api"}, map[string]interface{}{"exp": hour, "aud": "api"}, true},
+		{"audience in list", &JwtVerifier{Audience: "api"}, map[string]interface{}{"exp": hour, "aud": []interface{}{"web", "api"}}, true},
+		{"wrong audience", &JwtVerifier{Audience: "api"}, map[string]interface{}{"exp": hour, "aud": []interface{}{"web"}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.verifier.checkClaims(test.claims)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: valid %v expected, got error %v", test.name, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/naoina/denco"
+)
+
+// columns of composite types returned by procedures of large object routes
+var largeObjectColumns = FileColumns{
+	Content:     "oid",
+	ContentType: "content_type",
+	Filename:    "filename",
+	Etag:        "etag",
+}
+
+// makes a request handler streaming the large object whose OID is returned by the procedure
+func (h *RequestHandler) makeLargeObjectDownloadHandler(route *Route) denco.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		ctx := r.Context()
+		globalQuery := initGlobalQuery(route)
+		paramsDecoder(globalQuery, params, route.ParametersTypes)
+
+		query, err := prepareArgumentsFromQueryString(r.URL.RawQuery, route.ParametersTypes)
+		if err != nil {
+			panic(err)
+		}
+
+		for k, v := range globalQuery {
+			query[k] = v
+		}
+
+		tx, err := h.beginRequestTx(ctx, r, route, params)
+		if err != nil {
+			panic(err)
+		}
+		defer tx.Rollback(ctx)
+
+		tx.Audit = h.newAuditEntry(route, r, tx.Role, []map[string]interface{}{query})
+
+		sql := NewSqlBuilder()
+		if err := buildProcedureSqlQuery(&sql, route.ObjectName, true, false, query); err != nil {
+			panic(err)
+		}
+
+		var oid pgtype.OIDValue
+		var file FileDescription
+
+		rows, err := tx.Query(ctx, sql.Sql(), sql.Values()...)
+		if err != nil {
+			log.Println("While executing:", sql.Sql())
+			panic(err)
+		}
+
+		found := rows.Next()
+		if found {
+			err = scanFile(rows, largeObjectColumns, &oid, &file)
+		}
+		rows.Close()
+
+		if err != nil {
+			panic(err)
+		}
+		if rows.Err() != nil {
+			panic(rows.Err())
+		}
+
+		if !found || oid.Status != pgtype.Present {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Large object not found."))
+			return
+		}
+
+		// the procedure's transaction is committed and audited before any byte is sent, the large object is then read on its own
+		if err := h.commitRequestTx(ctx, w, tx); err != nil {
+			panic(err)
+		}
+
+		readTx, err := h.db.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+		if err != nil {
+			panic(err)
+		}
+		defer readTx.Rollback(ctx)
+
+		if err := setTxContext(ctx, readTx, h.StatementTimeoutSecs, tx.Role, h.ContextParameterName, tx.Context); err != nil {
+			panic(err)
+		}
+
+		largeObjects := readTx.LargeObjects()
+		lo, err := largeObjects.Open(ctx, oid.Uint, pgx.LargeObjectModeRead)
+		if err != nil {
+			panic(err)
+		}
+
+		contentType := file.ContentType.String
+		if contentType == "" {
+			contentType = h.extensionContentType(r)
+		}
+
+		setCacheControl(w, route.TTL, route.IsPublic)
+		serveFile(w, r, lo, contentType, file.Filename.String, file.Etag.String)
+
+		// the response has been sent already
+		if err := lo.Close(); err != nil {
+			log.Println("Error while closing large object:", err)
+		}
+	}
+}
+
+// makes a request handler streaming the body into a new large object, whose OID is passed to the procedure
+func (h *RequestHandler) makeLargeObjectUploadHandler(route *Route) denco.HandlerFunc {
+	oidArgument, _ := findLargeObjectArgument(route)
+
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		ctx := r.Context()
+		globalQuery := initGlobalQuery(route)
+		paramsDecoder(globalQuery, params, route.ParametersTypes)
+
+		// the body being the content, arguments are taken from the query string
+		query, err := prepareArgumentsFromQueryString(r.URL.RawQuery, route.ParametersTypes)
+		if err != nil {
+			panic(err)
+		}
+
+		responder, err := h.getResponder(r, h.MaxResponseSizeKbytes, route)
+		if err != nil {
+			panic(err)
+		}
+
+		tx, err := h.beginRequestTx(ctx, r, route, params)
+		if err != nil {
+			panic(err)
+		}
+		defer tx.Rollback(ctx)
+
+		largeObjects := tx.LargeObjects()
+		oid, err := largeObjects.Create(ctx, 0)
+		if err != nil {
+			panic(err)
+		}
+
+		lo, err := largeObjects.Open(ctx, oid, pgx.LargeObjectModeWrite)
+		if err != nil {
+			panic(err)
+		}
+
+		body := http.MaxBytesReader(w, r.Body, h.MaxLargeObjectSizeKbytes*1024)
+		if _, err := io.Copy(lo, body); err != nil {
+			panic(err)
+		}
+
+		if err := lo.Close(); err != nil {
+			panic(err)
+		}
+
+		query[oidArgument] = oid
+		if _, ok := route.ParametersTypes["content_type"]; ok {
+			query["content_type"] = r.Header.Get("Content-Type")
+		}
+
+		tx.Audit = h.newAuditEntry(route, r, tx.Role, []map[string]interface{}{query})
+
+		for k, v := range globalQuery {
+			query[k] = v
+		}
+
+		processProcedureQuery(ctx, route, tx, responder, query)
+
+		if err := h.commitRequestTx(ctx, w, tx); err != nil {
+			panic(err)
+		}
+
+		setCacheControl(w, route.TTL, route.IsPublic)
+		responder.HttpRespond(w)
+	}
+}
+
+// returns the name of the argument receiving the OID of uploaded large objects
+func findLargeObjectArgument(route *Route) (string, error) {
+	for name, typ := range route.ParametersTypes {
+		if typ.Name == "oid" {
+			return name, nil
+		}
+	}
+
+	return "", errors.New("Procedure '" + route.ObjectName + "' must have an argument of type oid to receive large objects.")
+}
+
+// checks that procedures of large object routes can be used for downloads
+func checkLargeObjectDownloadProc(route *Route) error {
+	if route.Proretset {
+		return errors.New("Procedure '" + route.ObjectName + "' must not return a set to download large objects.")
+	}
+
+	if route.Proretoid != pgtype.OIDOID && route.Prorettyptype != 'c' {
+		return errors.New("Procedure '" + route.ObjectName + "' must return an oid, or a composite type with an oid column, to download large objects.")
+	}
+
+	return nil
+}
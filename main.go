@@ -26,6 +26,11 @@ var (
 	serveCmd          = appCmdLine.Command("serve", "Start server.")
 	genDocCmd         = appCmdLine.Command("gendoc", "Generate documentation.")
 	docOutputPathArg  = genDocCmd.Arg("outputPath", "Destination file.").Required().String()
+	signCmd           = appCmdLine.Command("sign", "Print a signed URL.")
+	signUrlArg        = signCmd.Arg("url", "Path of the URL, with prefix, extension, and query string.").Required().String()
+	signMethodArg     = signCmd.Flag("method", "HTTP method.").Default("GET").String()
+	signExpiresInArg  = signCmd.Flag("expires-in", "Validity of the URL.").Default("24h").Duration()
+	signContextArg    = signCmd.Flag("context", "Context variable bound to the URL, as name=value.").StringMap()
 	serverCertificate *x509.Certificate
 )
 
@@ -47,13 +52,18 @@ var config struct {
 		UpdateForwardedForHeader bool
 		MaxHeaderSizeKbytes      int
 		MaxBodySizeKbytes        int64
+		MaxLargeObjectSizeKbytes int64
 		MaxResponseSizeKbytes    int64
 		ReadTimeoutSecs          int
 		WriteTimeoutSecs         int
 		//ShutdownTimeoutSecs int
-		CookiesDomain        string
-		CookiesPath          string
-		CookiesDisableSecure bool
+		CookiesDomain            string
+		CookiesPath              string
+		CookiesDisableSecure     bool
+		EventStreamKeepAliveSecs int
+		JobsUrlPath              string
+		ReadinessPath            string
+		MetricsPath              string
 	}
 
 	Postgres struct {
@@ -67,14 +77,112 @@ var config struct {
 		MaxOpenConnections   int32
 		ContextParameterName string
 		RoutesTableName      string
+		StrictRoutes         bool
 		FtsFunctionName      string
 		StatementTimeoutSecs int
+		ReloadIntervalSecs   int
 	}
 
 	Protocol struct {
-		FilterQueryName string
-		SortQueryName   string
-		LimitQueryName  string
+		FilterQueryName    string
+		SortQueryName      string
+		LimitQueryName     string
+		SelectQueryName    string
+		OffsetQueryName    string
+		CursorQueryName    string
+		CountQueryName     string
+		GroupQueryName     string
+		AggregateQueryName string
+		EmbedQueryName     string
+		// planned counts below this threshold are replaced by exact counts when estimated counts are requested
+		CountEstimateThreshold int64
+		// JSON records are wrapped as {"count":100,"records":[...]} when counted
+		CountEnvelope bool
+	}
+
+	Replication struct {
+		SlotName        string
+		PublicationName string
+		TemporarySlot   bool
+		BufferSize      int
+	}
+
+	Jwt struct {
+		Secret         string `redact:"true"`
+		JwksPath       string
+		JwksReloadSecs int
+		Audience       string
+		Issuer         string
+		LeewaySecs     int
+		AllowNoExp     bool
+		RoleClaim      string
+		ContextClaims  map[string]string
+		ClaimsVariable string
+	}
+
+	Admin struct {
+		Address  string
+		Token    string `redact:"true"`
+		Key      string
+		Cert     string
+		ClientCa string
+	}
+
+	ClientCertificates struct {
+		Identity            string
+		RolesTableName      string
+		SubjectVariable     string
+		FingerprintVariable string
+		CrlPath             string
+		CrlReloadSecs       int
+	}
+
+	Audit struct {
+		TableName       string
+		File            string
+		RequestIDHeader string
+		TrustedProxies  []string
+	}
+
+	Hooks struct {
+		PreRequestProcedure  string
+		PostRequestProcedure string
+	}
+
+	Csrf struct {
+		Mode            string
+		CookieName      string
+		HeaderName      string
+		AllowedOrigins  []string
+		ContextVariable string
+	}
+
+	SignedUrls struct {
+		Key     string `redact:"true"`
+		Role    string
+		Context map[string]string
+	}
+
+	ApiKeys struct {
+		TableName      string
+		ChannelName    string
+		HeaderName     string
+		QueryParameter string
+		KeyIDVariable  string
+		ScopesVariable string
+	}
+
+	Maintenance struct {
+		TableName      string
+		ChannelName    string
+		Message        string
+		RetryAfterSecs int
+	}
+
+	Jobs struct {
+		MaxConcurrentJobs    int
+		RetentionSecs        int
+		StatementTimeoutSecs int
 	}
 
 	DefaultContext map[string]string
@@ -90,9 +198,28 @@ func loadConfig(path string) {
 	config.Http.Address = ":https"
 	config.Http.ReadTimeoutSecs = 10
 	config.Http.WriteTimeoutSecs = 10
+	config.Http.EventStreamKeepAliveSecs = 30
+	config.Http.MaxLargeObjectSizeKbytes = 1048576
 	//config.Http.ShutdownTimeoutSecs = 60
 	config.Postgres.ContextParameterName = "context"
 	config.Postgres.RoutesTableName = "routes"
+	config.Replication.PublicationName = "pgasus"
+	config.Replication.TemporarySlot = true
+	config.Replication.BufferSize = 1024
+	config.Jwt.JwksReloadSecs = 300
+	config.Jwt.RoleClaim = "role"
+	config.ClientCertificates.Identity = CertIdentityCn
+	config.ClientCertificates.CrlReloadSecs = 300
+	config.Audit.RequestIDHeader = "X-Request-Id"
+	config.Csrf.CookieName = "csrf_token"
+	config.Csrf.HeaderName = "X-CSRF-Token"
+	config.ApiKeys.HeaderName = "X-API-Key"
+	config.Maintenance.Message = "Service under maintenance."
+	config.Maintenance.RetryAfterSecs = 300
+	config.Jobs.MaxConcurrentJobs = 2
+	config.Jobs.RetentionSecs = 3600
+	config.Jobs.StatementTimeoutSecs = 3600
+	config.Protocol.CountEstimateThreshold = 1000
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -108,6 +235,18 @@ func loadConfig(path string) {
 	if err := toml.Unmarshal(buf, &config); err != nil {
 		log.Fatalln("Cannot decode configuration file:", err)
 	}
+
+	if config.Http.EventStreamKeepAliveSecs < 0 {
+		log.Fatalln("Invalid event_stream_keep_alive_secs, 0 disables keep-alives.")
+	}
+
+	if config.Jwt.Secret != "" && config.Jwt.JwksPath != "" {
+		log.Fatalln("Either secret or jwks_path of jwt can be set, HS256 keys can be added to the JWKS file.")
+	}
+
+	if config.SignedUrls.Key != "" && config.SignedUrls.Role == "" {
+		log.Fatalln("Missing role of signed URLs.")
+	}
 }
 
 func checkServerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
@@ -216,6 +355,7 @@ func main() {
 		CookiesPath:          config.Http.CookiesPath,
 		CookiesDisableSecure: config.Http.CookiesDisableSecure,
 		RoutesTableName:      config.Postgres.RoutesTableName,
+		StrictRoutes:         config.Postgres.StrictRoutes,
 	}
 	handler.Verbose = config.System.Verbose
 	handler.UrlPrefix = config.Http.UrlPrefix
@@ -225,14 +365,74 @@ func main() {
 	handler.ContextParameterName = config.Postgres.ContextParameterName
 	handler.FtsFunctionName = config.Postgres.FtsFunctionName
 	handler.StatementTimeoutSecs = config.Postgres.StatementTimeoutSecs
+	handler.ReloadIntervalSecs = config.Postgres.ReloadIntervalSecs
 	handler.DefaultCn = config.Http.DefaultClientCn
 	handler.UpdateForwardedForHeader = config.Http.UpdateForwardedForHeader
 	handler.MaxBodySizeKbytes = config.Http.MaxBodySizeKbytes
+	handler.MaxLargeObjectSizeKbytes = config.Http.MaxLargeObjectSizeKbytes
 	handler.MaxResponseSizeKbytes = config.Http.MaxResponseSizeKbytes
 	handler.FilterQueryName = config.Protocol.FilterQueryName
 	handler.SortQueryName = config.Protocol.SortQueryName
 	handler.LimitQueryName = config.Protocol.LimitQueryName
+	handler.SelectQueryName = config.Protocol.SelectQueryName
+	handler.OffsetQueryName = config.Protocol.OffsetQueryName
+	handler.CursorQueryName = config.Protocol.CursorQueryName
+	handler.CountQueryName = config.Protocol.CountQueryName
+	handler.GroupQueryName = config.Protocol.GroupQueryName
+	handler.AggregateQueryName = config.Protocol.AggregateQueryName
+	handler.EmbedQueryName = config.Protocol.EmbedQueryName
+	handler.CountEstimateThreshold = config.Protocol.CountEstimateThreshold
+	handler.CountEnvelope = config.Protocol.CountEnvelope
 	handler.DefaultContext = config.DefaultContext
+	handler.EventStreamKeepAliveSecs = config.Http.EventStreamKeepAliveSecs
+	handler.ReplicationSlotName = config.Replication.SlotName
+	handler.ReplicationPublicationName = config.Replication.PublicationName
+	handler.ReplicationTemporarySlot = config.Replication.TemporarySlot
+	handler.ReplicationBufferSize = config.Replication.BufferSize
+	handler.JobsUrlPath = config.Http.JobsUrlPath
+	handler.MaxConcurrentJobs = config.Jobs.MaxConcurrentJobs
+	handler.JobsRetentionSecs = config.Jobs.RetentionSecs
+	handler.JobStatementTimeoutSecs = config.Jobs.StatementTimeoutSecs
+	handler.MaintenanceTableName = config.Maintenance.TableName
+	handler.MaintenanceChannelName = config.Maintenance.ChannelName
+	handler.MaintenanceMessage = config.Maintenance.Message
+	handler.MaintenanceRetryAfterSecs = config.Maintenance.RetryAfterSecs
+	handler.JwtSecret = config.Jwt.Secret
+	handler.JwtJwksPath = config.Jwt.JwksPath
+	handler.JwtJwksReloadSecs = config.Jwt.JwksReloadSecs
+	handler.JwtAudience = config.Jwt.Audience
+	handler.JwtIssuer = config.Jwt.Issuer
+	handler.JwtLeewaySecs = config.Jwt.LeewaySecs
+	handler.JwtAllowNoExp = config.Jwt.AllowNoExp
+	handler.JwtRoleClaim = config.Jwt.RoleClaim
+	handler.JwtContextClaims = config.Jwt.ContextClaims
+	handler.JwtClaimsVariable = config.Jwt.ClaimsVariable
+	handler.ApiKeysTableName = config.ApiKeys.TableName
+	handler.ApiKeysChannelName = config.ApiKeys.ChannelName
+	handler.ApiKeysHeaderName = config.ApiKeys.HeaderName
+	handler.ApiKeysQueryParameter = config.ApiKeys.QueryParameter
+	handler.ApiKeysKeyIDVariable = config.ApiKeys.KeyIDVariable
+	handler.ApiKeysScopesVariable = config.ApiKeys.ScopesVariable
+	handler.ClientCertIdentity = config.ClientCertificates.Identity
+	handler.ClientCertRolesTableName = config.ClientCertificates.RolesTableName
+	handler.ClientCertSubjectVariable = config.ClientCertificates.SubjectVariable
+	handler.ClientCertFingerprintVariable = config.ClientCertificates.FingerprintVariable
+	handler.AuditTableName = config.Audit.TableName
+	handler.AuditFilePath = config.Audit.File
+	handler.AuditRequestIDHeader = config.Audit.RequestIDHeader
+	handler.AuditTrustedProxies = config.Audit.TrustedProxies
+	handler.PreRequestProcedure = config.Hooks.PreRequestProcedure
+	handler.PostRequestProcedure = config.Hooks.PostRequestProcedure
+	handler.CsrfMode = config.Csrf.Mode
+	handler.CsrfCookieName = config.Csrf.CookieName
+	handler.CsrfHeaderName = config.Csrf.HeaderName
+	handler.CsrfAllowedOrigins = config.Csrf.AllowedOrigins
+	handler.CsrfContextVariable = config.Csrf.ContextVariable
+	handler.SignedUrlsKey = config.SignedUrls.Key
+	handler.SignedUrlsRole = config.SignedUrls.Role
+	handler.SignedUrlsContext = config.SignedUrls.Context
+	handler.ReadinessPath = config.Http.ReadinessPath
+	handler.MetricsPath = config.Http.MetricsPath
 
 	handler.BinaryFormats = make(map[string]string)
 	for _, x := range config.BinaryFormats {
@@ -244,6 +444,8 @@ func main() {
 		startServer(handler)
 	case genDocCmd.FullCommand():
 		generateDocumentation(handler)
+	case signCmd.FullCommand():
+		signUrlCommand(handler, *signMethodArg, *signUrlArg, *signExpiresInArg, *signContextArg)
 	default:
 		log.Fatalln("No command provided.")
 	}
@@ -275,11 +477,36 @@ func startServer(handler RequestHandler) {
 		},
 	}
 
+	// certificates are only requested when they identify clients, browsers would prompt for one otherwise
+	if config.Http.ClientCa != "" && config.Http.DefaultClientCn != "" {
+		svr.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if config.ClientCertificates.CrlPath != "" {
+		crlChecker := &CrlChecker{
+			Path:       config.ClientCertificates.CrlPath,
+			ReloadSecs: config.ClientCertificates.CrlReloadSecs,
+		}
+		if _, err := crlChecker.revocationLists(); err != nil {
+			log.Fatalln(err)
+		}
+		svr.TLSConfig.VerifyPeerCertificate = crlChecker.VerifyPeerCertificate
+	}
+
+	var adminSvr *http.Server
+	if config.Admin.Address != "" {
+		adminSvr = startAdminServer(&handler)
+	}
+
 	svr.RegisterOnShutdown(func() {
 		if config.System.Verbose {
 			log.Println("pgasus shutdown requested.")
 		}
 		handler.StopReloads()
+
+		if adminSvr != nil {
+			adminSvr.Close()
+		}
 	})
 
 	idleConnsClosed := make(chan struct{})
@@ -313,14 +540,59 @@ func startServer(handler RequestHandler) {
 	handler.CloseRequestsLogFile()
 }
 
+// starts the admin API on its own listener, protected by a token and/or client certificates
+func startAdminServer(handler *RequestHandler) *http.Server {
+	if config.Admin.Token == "" && config.Admin.ClientCa == "" {
+		log.Fatalln("Admin listener requires a token or a client CA.")
+	}
+
+	svr := &http.Server{
+		Addr:         config.Admin.Address,
+		Handler:      NewAdminHandler(handler, config.Admin.Token, &config),
+		ReadTimeout:  time.Duration(config.Http.ReadTimeoutSecs) * time.Second,
+		WriteTimeout: time.Duration(config.Http.WriteTimeoutSecs) * time.Second,
+	}
+
+	if config.Admin.ClientCa != "" {
+		svr.TLSConfig = &tls.Config{
+			ClientCAs:  loadX509Pool(config.Admin.ClientCa),
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	go func() {
+		var err error
+		if config.Admin.Key != "" && config.Admin.Cert != "" {
+			err = svr.ListenAndServeTLS(config.Admin.Cert, config.Admin.Key)
+		} else if svr.TLSConfig != nil {
+			log.Fatalln("Admin listener requires a key and a certificate to verify client certificates.")
+		} else {
+			err = svr.ListenAndServe()
+		}
+
+		if err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+
+	return svr
+}
+
 func generateDocumentation(handler RequestHandler) {
 	docGen := DocumentationGenerator{
-		DbConnConfig:    handler.DbConnConfig,
-		Schema:          handler.Schema,
-		SearchPath:      config.Postgres.SearchPath,
-		FilterQueryName: config.Protocol.FilterQueryName,
-		SortQueryName:   config.Protocol.SortQueryName,
-		LimitQueryName:  config.Protocol.LimitQueryName,
+		DbConnConfig:       handler.DbConnConfig,
+		Schema:             handler.Schema,
+		SearchPath:         config.Postgres.SearchPath,
+		FilterQueryName:    config.Protocol.FilterQueryName,
+		SortQueryName:      config.Protocol.SortQueryName,
+		LimitQueryName:     config.Protocol.LimitQueryName,
+		SelectQueryName:    config.Protocol.SelectQueryName,
+		OffsetQueryName:    config.Protocol.OffsetQueryName,
+		CursorQueryName:    config.Protocol.CursorQueryName,
+		CountQueryName:     config.Protocol.CountQueryName,
+		GroupQueryName:     config.Protocol.GroupQueryName,
+		AggregateQueryName: config.Protocol.AggregateQueryName,
+		EmbedQueryName:     config.Protocol.EmbedQueryName,
 	}
 
 	docGen.GenerateDocumentation(*docOutputPathArg)
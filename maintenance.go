@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/naoina/denco"
+)
+
+const (
+	ModeOnline   = "online"
+	ModeReadOnly = "read_only"
+	ModeOffline  = "offline"
+)
+
+// MaintenanceState is read from the maintenance table, and replaced as a whole when updated
+type MaintenanceState struct {
+	Mode           string
+	Message        string
+	RetryAfterSecs int
+	ExemptRoles    map[string]struct{}
+}
+
+// returns the current maintenance state, online until loaded
+func (h *RequestHandler) maintenanceState() *MaintenanceState {
+	if state, ok := h.maintenance.Load().(*MaintenanceState); ok {
+		return state
+	}
+
+	return &MaintenanceState{Mode: ModeOnline}
+}
+
+// reads the maintenance mode from its table, the previous state is kept on errors
+func (h *RequestHandler) loadMaintenance(ctx context.Context, tx pgx.Tx) error {
+	if h.MaintenanceTableName == "" {
+		return nil
+	}
+
+	var mode pgtype.Text
+	var message pgtype.Text
+	var retryAfterSecs pgtype.Int4
+	var exemptRoles []string
+
+	err := tx.QueryRow(ctx, `SELECT mode,message,retry_after_secs,exempt_roles FROM `+quoteIdentifier(h.MaintenanceTableName)+` LIMIT 1`).Scan(&mode, &message, &retryAfterSecs, &exemptRoles)
+	if err == pgx.ErrNoRows {
+		mode.String = ModeOnline
+	} else if err != nil {
+		return err
+	}
+
+	state := &MaintenanceState{
+		Mode:           mode.String,
+		Message:        h.MaintenanceMessage,
+		RetryAfterSecs: h.MaintenanceRetryAfterSecs,
+		ExemptRoles:    make(map[string]struct{}),
+	}
+
+	if message.Status == pgtype.Present {
+		state.Message = message.String
+	}
+	if retryAfterSecs.Status == pgtype.Present {
+		state.RetryAfterSecs = int(retryAfterSecs.Int)
+	}
+	for _, role := range exemptRoles {
+		state.ExemptRoles[role] = struct{}{}
+	}
+
+	if previous := h.maintenanceState(); previous.Mode != state.Mode {
+		log.Println("Maintenance mode:", state.Mode)
+	}
+
+	h.maintenance.Store(state)
+
+	return nil
+}
+
+// reloads the maintenance mode in its own transaction
+func (h *RequestHandler) reloadMaintenance() error {
+	ctx := context.Background()
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	return h.loadMaintenance(ctx, tx)
+}
+
+// makes a request handler answering 503 while in maintenance, unless the route or the client's role is exempted
+// in read-only mode, GET routes remain available
+func (h *RequestHandler) makeMaintenanceHandler(route *Route, next denco.HandlerFunc) denco.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		state := h.maintenanceState()
+
+		if state.Mode == ModeOnline || (state.Mode == ModeReadOnly && route.Method == "get") {
+			next(w, r, params)
+			return
+		}
+
+		if len(state.ExemptRoles) > 0 && h.isMaintenanceExempt(r, state) {
+			next(w, r, params)
+			return
+		}
+
+		if state.RetryAfterSecs > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfterSecs))
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(state.Message))
+	}
+}
+
+// checks whether the client's role is exempted from maintenance, without a transaction
+// certificates are checked in memory, only passwords of HTTP Basic authentication are checked against the database
+func (h *RequestHandler) isMaintenanceExempt(r *http.Request, state *MaintenanceState) bool {
+	role, err := getClientRole(r.Context(), h.db, r, h.DefaultCn)
+	if err != nil {
+		panic(err)
+	}
+
+	_, ok := state.ExemptRoles[role]
+	return ok
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	queryme "github.com/debackerl/queryme/go"
+	"github.com/jackc/pgtype"
+)
+
+// name of the column with the cursor of each record, read but not sent to clients
+const cursorColumnName = "pgasus_cursor"
+
+// Cursor locates a record in a sort order, sent to clients as an opaque string
+type Cursor struct {
+	Order    []string  `json:"o"` // fields of sort order, prefixed by ! if descending
+	Values   []*string `json:"v"` // values of fields as text, nil for NULL
+	Backward bool      `json:"b"` // true if records before the cursor are requested
+}
+
+// Page is the part of the result requested by the client
+// keyset pagination is used on routes with a cursor column, unless an offset is requested
+type Page struct {
+	Offset int64
+	Keyset bool
+	Order  []*queryme.SortOrder // sort order of keyset pagination, with the cursor column as last tiebreaker
+	Cursor *Cursor              // nil for the first page
+}
+
+func encodeCursor(cursor *Cursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := &Cursor{}
+	if err := json.Unmarshal(raw, cursor); err != nil {
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+func sortOrderFields(order []*queryme.SortOrder) []string {
+	fields := make([]string, len(order))
+	for i, o := range order {
+		fields[i] = string(o.Field)
+		if !o.Ascending {
+			fields[i] = "!" + fields[i]
+		}
+	}
+	return fields
+}
+
+// reads offset and cursor from query string, order is the sort order requested by the client
+// keyset pagination is disabled if keyset is false, e.g. for aggregations
+func parsePage(r *http.Request, offsetQueryName string, cursorQueryName string, route *Route, order []*queryme.SortOrder, keyset bool) (*Page, error) {
+	query := r.URL.Query()
+	page := &Page{}
+
+	rawOffset := ""
+	if offsetQueryName != "" {
+		rawOffset = query.Get(offsetQueryName)
+	}
+	rawCursor := ""
+	if cursorQueryName != "" {
+		rawCursor = query.Get(cursorQueryName)
+	}
+
+	if rawOffset != "" && rawCursor != "" {
+		return nil, &HttpError{Status: http.StatusBadRequest, Err: errors.New("Offset and cursor can't be combined.")}
+	}
+
+	if rawOffset != "" {
+		offset, err := strconv.ParseInt(rawOffset, 10, 64)
+		if err != nil || offset < 0 {
+			return nil, &HttpError{Status: http.StatusBadRequest, Err: errors.New("Invalid offset.")}
+		}
+		page.Offset = offset
+		return page, nil
+	}
+
+	if route.CursorColumn == "" || !keyset {
+		if rawCursor != "" {
+			return nil, &HttpError{Status: http.StatusBadRequest, Err: errors.New("Cursors unsupported on this request.")}
+		}
+		return page, nil
+	}
+
+	page.Keyset = true
+	page.Order = make([]*queryme.SortOrder, 0, len(order)+1)
+	tiebreaker := false
+	for _, o := range order {
+		_, ok := route.ParametersDeclTypes[string(o.Field)]
+		if _, hidden := route.HiddenFields[string(o.Field)]; !ok || hidden {
+			return nil, &HttpError{Status: http.StatusBadRequest, Err: errors.New("Unknown column " + string(o.Field) + ".")}
+		}
+		// records with NULL sort keys can't be located by cursors
+		if _, ok := route.NotNullFields[string(o.Field)]; !ok {
+			return nil, &HttpError{Status: http.StatusBadRequest, Err: errors.New("Column " + string(o.Field) + " is nullable, request an offset to sort by it.")}
+		}
+		if string(o.Field) == route.CursorColumn {
+			tiebreaker = true
+		}
+		page.Order = append(page.Order, o)
+	}
+	if !tiebreaker {
+		page.Order = append(page.Order, &queryme.SortOrder{Field: queryme.Field(route.CursorColumn), Ascending: true})
+	}
+
+	if rawCursor != "" {
+		cursor, err := decodeCursor(rawCursor)
+		if err != nil {
+			return nil, &HttpError{Status: http.StatusBadRequest, Err: errors.New("Invalid cursor.")}
+		}
+
+		if len(cursor.Values) != len(page.Order) || strings.Join(cursor.Order, ",") != strings.Join(sortOrderFields(page.Order), ",") {
+			return nil, &HttpError{Status: http.StatusBadRequest, Err: errors.New("Cursor doesn't match sort order.")}
+		}
+
+		page.Cursor = cursor
+	}
+
+	return page, nil
+}
+
+// PageBounds describes records read, cursors are only known for keyset pagination
+type PageBounds struct {
+	Count     int64
+	First     pgtype.TextArray // cursor values of first record
+	Last      pgtype.TextArray // cursor values of last record
+	Truncated []string         // aliases of embeddings truncated in some records
+}
+
+func (bounds *PageBounds) isTruncated(alias string) bool {
+	for _, truncated := range bounds.Truncated {
+		if truncated == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// sets Link headers to next and previous pages, see RFC 8288
+// a next page is linked if the page is full, since more records may follow
+func setPageLinks(w http.ResponseWriter, r *http.Request, offsetQueryName string, cursorQueryName string, page *Page, limit int64, bounds *PageBounds) {
+	if limit <= 0 {
+		return
+	}
+
+	full := bounds.Count >= limit
+
+	if page.Keyset {
+		if cursorQueryName == "" {
+			return
+		}
+
+		fields := sortOrderFields(page.Order)
+		moreAfter := full || (page.Cursor != nil && page.Cursor.Backward)
+		moreBefore := page.Cursor != nil && (!page.Cursor.Backward || full)
+
+		if moreAfter && bounds.Count > 0 {
+			cursor := &Cursor{Order: fields, Values: cursorValues(&bounds.Last)}
+			w.Header().Add("Link", pageLink(r, offsetQueryName, cursorQueryName, cursorQueryName, encodeCursor(cursor), "next"))
+		}
+		if moreBefore && bounds.Count > 0 {
+			cursor := &Cursor{Order: fields, Values: cursorValues(&bounds.First), Backward: true}
+			w.Header().Add("Link", pageLink(r, offsetQueryName, cursorQueryName, cursorQueryName, encodeCursor(cursor), "prev"))
+		}
+
+		return
+	}
+
+	if offsetQueryName == "" {
+		return
+	}
+
+	if full {
+		w.Header().Add("Link", pageLink(r, offsetQueryName, cursorQueryName, offsetQueryName, strconv.FormatInt(page.Offset+limit, 10), "next"))
+	}
+	if page.Offset > 0 {
+		prev := page.Offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		w.Header().Add("Link", pageLink(r, offsetQueryName, cursorQueryName, offsetQueryName, strconv.FormatInt(prev, 10), "prev"))
+	}
+}
+
+func cursorValues(values *pgtype.TextArray) []*string {
+	result := make([]*string, len(values.Elements))
+	for i := range values.Elements {
+		if values.Elements[i].Status == pgtype.Present {
+			result[i] = &values.Elements[i].String
+		}
+	}
+	return result
+}
+
+// returns the requested URL with the given query parameter, other pagination parameters are removed
+func pageLink(r *http.Request, offsetQueryName string, cursorQueryName string, name string, value string, rel string) string {
+	query := r.URL.Query()
+	if offsetQueryName != "" {
+		query.Del(offsetQueryName)
+	}
+	if cursorQueryName != "" {
+		query.Del(cursorQueryName)
+	}
+	query.Set(name, value)
+
+	link := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	// the path of the request was stripped of its prefix and extension before routing
+	if requestUrl, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		link.Path = requestUrl.Path
+	}
+
+	return "<" + link.String() + ">; rel=\"" + rel + "\""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	queryme "github.com/debackerl/queryme/go"
+)
+
+func TestCursorEncoding(t *testing.T) {
+	name := "a,b/c"
+	id := "42"
+
+	cursors := []*Cursor{
+		{Order: []string{"name", "id"}, Values: []*string{&name, &id}},
+		{Order: []string{"!name", "id"}, Values: []*string{nil, &id}, Backward: true},
+		{Order: []string{}, Values: []*string{}},
+	}
+
+	for _, cursor := range cursors {
+		encoded := encodeCursor(cursor)
+		if _, err := base64.RawURLEncoding.DecodeString(encoded); err != nil {
+			t.Errorf("cursor %s not URL-safe: %v", encoded, err)
+		}
+
+		decoded, err := decodeCursor(encoded)
+		if err != nil {
+			t.Errorf("cursor %s: %v", encoded, err)
+		} else if !reflect.DeepEqual(decoded, cursor) {
+			t.Errorf("cursor %+v expected, got %+v", cursor, decoded)
+		}
+	}
+
+	invalid := []string{
+		"not base64!",
+		base64.StdEncoding.EncodeToString([]byte(`{"o":["id"],"v":["1"]}`)), // padded
+		base64.RawURLEncoding.EncodeToString([]byte(`{"o":`)),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"o":"id"}`)),
+	}
+
+	for _, s := range invalid {
+		if _, err := decodeCursor(s); err == nil {
+			t.Errorf("invalid cursor %s accepted", s)
+		}
+	}
+}
+
+func TestParsePageCursor(t *testing.T) {
+	route := &Route{
+		CursorColumn:        "id",
+		ParametersDeclTypes: map[string]string{"id": "integer", "name": "text", "note": "text"},
+		NotNullFields:       map[string]struct{}{"id": {}, "name": {}},
+	}
+	order := []*queryme.SortOrder{{Field: "name", Ascending: false}}
+
+	id := "42"
+	name := "z"
+	matching := encodeCursor(&Cursor{Order: []string{"!name", "id"}, Values: []*string{&name, &id}})
+
+	tests := []struct {
+		name  string
+		query string
+		order []*queryme.SortOrder
+		valid bool
+	}{
+		{"first page", "", order, true},
+		{"matching cursor", "cursor=" + matching, order, true},
+		{"other sort order", "cursor=" + encodeCursor(&Cursor{Order: []string{"name", "id"}, Values: []*string{&name, &id}}), order, false},
+		{"missing values", "cursor=" + encodeCursor(&Cursor{Order: []string{"!name", "id"}, Values: []*string{&name}}), order, false},
+		{"invalid cursor", "cursor=abc!", order, false},
+		{"cursor and offset", "cursor=" + matching + "&offset=10", order, false},
+		{"nullable sort key", "", []*queryme.SortOrder{{Field: "note", Ascending: true}}, false},
+		{"unknown sort key", "", []*queryme.SortOrder{{Field: "other", Ascending: true}}, false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/?"+test.query, nil)
+
+		page, err := parsePage(r, "offset", "cursor", route, test.order, true)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: valid %v expected, got error %v", test.name, test.valid, err)
+			continue
+		}
+
+		if test.valid && (!page.Keyset || len(page.Order) != 2 || page.Order[1].Field != "id") {
+			t.Errorf("%s: keyset pagination with id as tiebreaker expected, got %+v", test.name, page)
+		}
+	}
+
+	// e.g. aggregations, which have no cursor column
+	r := httptest.NewRequest("GET", "/?cursor="+matching, nil)
+	if _, err := parsePage(r, "offset", "cursor", route, order, false); err == nil {
+		t.Error("cursor accepted while keyset pagination is disabled")
+	}
+}
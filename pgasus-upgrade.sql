@@ -0,0 +1,50 @@
+-- upgrades the schema of existing installations to the columns read by this version of pgasus
+-- statements can be run several times, tables of optional features are created by their section of pgasus.sql
+-- ALTER TYPE ... ADD VALUE can't run in a transaction block before PostgreSQL 12, run this script with autocommit
+
+SET search_path = pgasus, pg_catalog;
+
+-- channels
+ALTER TYPE object_type ADD VALUE IF NOT EXISTS 'channel';
+-- context_mapped_cookies was already read by pgasus, but missing from pgasus.sql
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS context_mapped_cookies jsonb;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS channel_procedure text;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS channel_filter boolean NOT NULL DEFAULT false;
+
+-- realtime relations
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS realtime boolean NOT NULL DEFAULT false;
+
+-- asynchronous procedures
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS async boolean NOT NULL DEFAULT false;
+
+-- large objects
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS large_object boolean NOT NULL DEFAULT false;
+
+-- files stored in columns
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS content_column text;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS content_type_column text;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS filename_column text;
+
+-- maintenance mode
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS maintenance_exempt boolean NOT NULL DEFAULT false;
+
+-- CSRF protection
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS csrf_protection text;
+
+-- authorization
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS allowed_roles text[] NOT NULL DEFAULT ARRAY[]::text[];
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS required_scopes text[] NOT NULL DEFAULT ARRAY[]::text[];
+
+-- hooks
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS hooks_exempt boolean NOT NULL DEFAULT false;
+
+-- audit
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS audit_reads boolean NOT NULL DEFAULT false;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS audit_redacted_fields text[] NOT NULL DEFAULT ARRAY[]::text[];
+
+-- keyset pagination
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS cursor_column text;
+
+-- aggregation
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS aggregation boolean NOT NULL DEFAULT false;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS max_groups integer;
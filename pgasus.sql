@@ -12,7 +12,8 @@ CREATE TYPE http_method AS ENUM (
 
 CREATE TYPE object_type AS ENUM (
 	'relation',
-	'procedure'
+	'procedure',
+	'channel'
 );
 
 CREATE TABLE routes (
@@ -29,6 +30,25 @@ CREATE TABLE routes (
 	max_limit integer NOT NULL DEFAULT 0, -- maximum number of records that can be requested when using a select statement
 	hidden_fields text[] NOT NULL DEFAULT ARRAY[]::text[], -- used for searchable fields which should not be displayed
 	readonly_fields text[] NOT NULL DEFAULT ARRAY[]::text[], -- fields that could not be saved via insert or update statements
+	context_mapped_cookies jsonb, -- context variables imported from cookies of requests and exported as cookies in responses
+	channel_procedure text, -- stable procedure with a payload argument, returning true if notifications of channel can be sent
+	channel_filter boolean NOT NULL DEFAULT false, -- channel_procedure is called for each payload if true, or only once without payload otherwise
+	realtime boolean NOT NULL DEFAULT false, -- changes of relation can be streamed in get routes
+	async boolean NOT NULL DEFAULT false, -- procedure is executed in background, and a job URL is returned
+	large_object boolean NOT NULL DEFAULT false, -- large object whose oid is returned by procedure is downloaded, or body is uploaded into new large object passed to procedure
+	content_column text, -- bytea column of relation downloaded as a file by get routes
+	content_type_column text, -- column of relation with MIME type of downloaded file
+	filename_column text, -- column of relation with filename of downloaded file
+	maintenance_exempt boolean NOT NULL DEFAULT false, -- route remains available during maintenance
+	csrf_protection text, -- none, double_submit, or origin, the protection of the configuration file is used if null
+	allowed_roles text[] NOT NULL DEFAULT ARRAY[]::text[], -- roles of clients allowed, checked before any query, all roles if empty
+	required_scopes text[] NOT NULL DEFAULT ARRAY[]::text[], -- scopes of tokens or API keys required, checked before any query
+	hooks_exempt boolean NOT NULL DEFAULT false, -- pre-request and post-request procedures are not called for this route
+	audit_reads boolean NOT NULL DEFAULT false, -- get requests are audited
+	audit_redacted_fields text[] NOT NULL DEFAULT ARRAY[]::text[], -- fields of request bodies replaced by REDACTED in audit entries
+	cursor_column text, -- unique column of relation used as last sort key of cursors, enables keyset pagination
+	aggregation boolean NOT NULL DEFAULT false, -- records of get requests on relations can be grouped and aggregated
+	max_groups integer, -- maximum number of groups returned by aggregations
 	CONSTRAINT rules_rule_id_pkey PRIMARY KEY (route_id)
 );
 
@@ -42,6 +62,25 @@ COMMENT ON COLUMN routes.context_mapped_variables IS 'context variables copied f
 COMMENT ON COLUMN routes.max_limit IS 'maximum number of records that can be requested when using a select statement';
 COMMENT ON COLUMN routes.hidden_fields IS 'used for searchable fields which should not be displayed';
 COMMENT ON COLUMN routes.readonly_fields IS 'fields that could not be saved via insert or update statements';
+COMMENT ON COLUMN routes.context_mapped_cookies IS 'context variables imported from cookies of requests and exported as cookies in responses';
+COMMENT ON COLUMN routes.channel_procedure IS 'stable procedure with a payload argument, returning true if notifications of channel can be sent';
+COMMENT ON COLUMN routes.channel_filter IS 'channel_procedure is called for each payload if true, or only once without payload otherwise';
+COMMENT ON COLUMN routes.realtime IS 'changes of relation can be streamed in get routes';
+COMMENT ON COLUMN routes.async IS 'procedure is executed in background, and a job URL is returned';
+COMMENT ON COLUMN routes.large_object IS 'large object whose oid is returned by procedure is downloaded, or body is uploaded into new large object passed to procedure';
+COMMENT ON COLUMN routes.content_column IS 'bytea column of relation downloaded as a file by get routes';
+COMMENT ON COLUMN routes.content_type_column IS 'column of relation with MIME type of downloaded file';
+COMMENT ON COLUMN routes.filename_column IS 'column of relation with filename of downloaded file';
+COMMENT ON COLUMN routes.maintenance_exempt IS 'route remains available during maintenance';
+COMMENT ON COLUMN routes.csrf_protection IS 'none, double_submit, or origin, the protection of the configuration file is used if null';
+COMMENT ON COLUMN routes.allowed_roles IS 'roles of clients allowed, checked before any query, all roles if empty';
+COMMENT ON COLUMN routes.required_scopes IS 'scopes of tokens or API keys required, checked before any query';
+COMMENT ON COLUMN routes.hooks_exempt IS 'pre-request and post-request procedures are not called for this route';
+COMMENT ON COLUMN routes.audit_reads IS 'get requests are audited';
+COMMENT ON COLUMN routes.audit_redacted_fields IS 'fields of request bodies replaced by REDACTED in audit entries';
+COMMENT ON COLUMN routes.cursor_column IS 'unique column of relation used as last sort key of cursors, enables keyset pagination';
+COMMENT ON COLUMN routes.aggregation IS 'records of get requests on relations can be grouped and aggregated';
+COMMENT ON COLUMN routes.max_groups IS 'maximum number of groups returned by aggregations';
 
 CREATE OR REPLACE FUNCTION routes_notify_trigger()
 	RETURNS trigger AS
@@ -59,3 +98,104 @@ CREATE TRIGGER routes_updated_trigger
 	ON routes
 	FOR EACH STATEMENT
 	EXECUTE PROCEDURE routes_notify_trigger();
+
+CREATE TABLE audit
+(
+	time timestamp with time zone NOT NULL,
+	route_id integer NOT NULL,
+	method text NOT NULL,
+	role text NOT NULL, -- role of the client, empty if impersonation is disabled
+	client_ip text NOT NULL,
+	request_id text NOT NULL, -- value of the request ID header, empty if missing
+	filter text NOT NULL, -- filter of the query string, empty if missing
+	body jsonb, -- arguments of each query, with redacted fields
+	rows_affected bigint -- null for procedures and reads
+);
+
+COMMENT ON COLUMN audit.role IS 'role of the client, empty if impersonation is disabled';
+COMMENT ON COLUMN audit.request_id IS 'value of the request ID header, empty if missing';
+COMMENT ON COLUMN audit.filter IS 'filter of the query string, empty if missing';
+COMMENT ON COLUMN audit.body IS 'arguments of each query, with redacted fields';
+COMMENT ON COLUMN audit.rows_affected IS 'null for procedures and reads';
+
+CREATE TABLE client_certificates
+(
+	identity text NOT NULL, -- attribute of client certificates set as identity in the configuration file
+	role text NOT NULL, -- database role of requests authenticated by such certificates
+	CONSTRAINT client_certificates_identity_pkey PRIMARY KEY (identity)
+);
+
+COMMENT ON COLUMN client_certificates.identity IS 'attribute of client certificates set as identity in the configuration file';
+COMMENT ON COLUMN client_certificates.role IS 'database role of requests authenticated by such certificates';
+
+CREATE TABLE api_keys
+(
+	key_id text NOT NULL, -- public identifier of the key
+	key_hash bytea NOT NULL, -- SHA-256 hash of the key, e.g. sha256(convert_to('key', 'UTF8'))
+	role text NOT NULL, -- database role of requests authenticated by this key
+	expires_at timestamp with time zone, -- key is rejected after this time, never expires if null
+	scopes text[] NOT NULL DEFAULT ARRAY[]::text[], -- exposed to the database as context variable
+	route_ids integer[] NOT NULL DEFAULT ARRAY[]::integer[], -- routes allowed, all routes if empty
+	last_used_at timestamp with time zone, -- updated asynchronously by pgasus
+	CONSTRAINT api_keys_key_id_pkey PRIMARY KEY (key_id),
+	CONSTRAINT api_keys_key_hash_key UNIQUE (key_hash)
+);
+
+COMMENT ON COLUMN api_keys.key_id IS 'public identifier of the key';
+COMMENT ON COLUMN api_keys.key_hash IS 'SHA-256 hash of the key, e.g. sha256(convert_to(''key'', ''UTF8''))';
+COMMENT ON COLUMN api_keys.role IS 'database role of requests authenticated by this key';
+COMMENT ON COLUMN api_keys.expires_at IS 'key is rejected after this time, never expires if null';
+COMMENT ON COLUMN api_keys.scopes IS 'exposed to the database as context variable';
+COMMENT ON COLUMN api_keys.route_ids IS 'routes allowed, all routes if empty';
+COMMENT ON COLUMN api_keys.last_used_at IS 'updated asynchronously by pgasus';
+
+CREATE OR REPLACE FUNCTION api_keys_notify_trigger()
+	RETURNS trigger AS
+$BODY$
+begin
+	NOTIFY "pgasus.api_keys";
+	RETURN NULL;
+end
+$BODY$
+	LANGUAGE plpgsql VOLATILE
+	COST 100;
+
+-- updates of last_used_at don't invalidate the cache of pgasus
+CREATE TRIGGER api_keys_updated_trigger
+	AFTER INSERT OR DELETE OR TRUNCATE OR UPDATE OF key_id, key_hash, role, expires_at, scopes, route_ids
+	ON api_keys
+	FOR EACH STATEMENT
+	EXECUTE PROCEDURE api_keys_notify_trigger();
+
+CREATE TABLE maintenance
+(
+	mode text NOT NULL DEFAULT 'online', -- online, read_only (only get routes are available), or offline
+	message text, -- body of 503 responses, the default message of the configuration file is used if null
+	retry_after_secs integer, -- value of Retry-After header of 503 responses, the default value of the configuration file is used if null
+	exempt_roles text[] NOT NULL DEFAULT ARRAY[]::text[], -- roles of clients still served during maintenance
+	CONSTRAINT maintenance_mode_check CHECK (mode IN ('online', 'read_only', 'offline'))
+);
+
+COMMENT ON COLUMN maintenance.mode IS 'online, read_only (only get routes are available), or offline';
+COMMENT ON COLUMN maintenance.message IS 'body of 503 responses, the default message of the configuration file is used if null';
+COMMENT ON COLUMN maintenance.retry_after_secs IS 'value of Retry-After header of 503 responses, the default value of the configuration file is used if null';
+COMMENT ON COLUMN maintenance.exempt_roles IS 'roles of clients still served during maintenance';
+
+INSERT INTO maintenance (mode) VALUES ('online');
+
+CREATE OR REPLACE FUNCTION maintenance_notify_trigger()
+	RETURNS trigger AS
+$BODY$
+begin
+	NOTIFY "pgasus.maintenance";
+	RETURN NULL;
+end
+$BODY$
+	LANGUAGE plpgsql VOLATILE
+	COST 100;
+
+CREATE TRIGGER maintenance_updated_trigger
+	AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE
+	ON maintenance
+	FOR EACH STATEMENT
+	EXECUTE PROCEDURE maintenance_notify_trigger();
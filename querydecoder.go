@@ -5,7 +5,10 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"strings"
@@ -20,7 +23,18 @@ func decodeHttpBody(w http.ResponseWriter, r *http.Request, argumentsType map[st
 
 	queries = make([]map[string]interface{}, 0, 1)
 
-	if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+	mediaType, mediaParams, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType == "multipart/form-data" {
+		var query map[string]interface{}
+		query, err = prepareArgumentsFromMultipart(multipart.NewReader(body, mediaParams["boundary"]), argumentsType, readonlyFields)
+		if err != nil {
+			queries = nil
+			return
+		}
+
+		queries = append(queries, query)
+	} else if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
 		buf := new(bytes.Buffer)
 		buf.ReadFrom(body)
 
@@ -101,6 +115,70 @@ func prepareArgumentsFromForm(arguments url.Values, argumentsType map[string]Arg
 	return
 }
 
+// parts are read one by one, the body size limit applies while reading them
+// files are passed to bytea arguments, and their name and content type to optional <name>_filename and <name>_content_type arguments
+func prepareArgumentsFromMultipart(reader *multipart.Reader, argumentsType map[string]ArgumentType, readonlyFields map[string]struct{}) (query map[string]interface{}, err error) {
+	query = make(map[string]interface{})
+
+	for {
+		var part *multipart.Part
+		part, err = reader.NextPart()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		key := strings.ToLower(part.FormName())
+
+		if readonlyFields != nil {
+			if _, ok := readonlyFields[key]; ok {
+				continue
+			}
+		}
+
+		typ, ok := argumentsType[key]
+		if !ok {
+			continue
+		}
+
+		var content []byte
+		content, err = io.ReadAll(part)
+		if err != nil {
+			return
+		}
+
+		if typ.Name == "bytea" {
+			query[key] = pgtype.Bytea{
+				Bytes:  content,
+				Status: pgtype.Present,
+			}
+		} else {
+			query[key] = string(content)
+		}
+
+		if filename := part.FileName(); filename != "" {
+			if isWritableArgument(key+"_filename", argumentsType, readonlyFields) {
+				query[key+"_filename"] = filename
+			}
+			if isWritableArgument(key+"_content_type", argumentsType, readonlyFields) {
+				query[key+"_content_type"] = part.Header.Get("Content-Type")
+			}
+		}
+	}
+}
+
+// true if the argument exists and isn't read-only
+func isWritableArgument(name string, argumentsType map[string]ArgumentType, readonlyFields map[string]struct{}) bool {
+	if _, ok := readonlyFields[name]; ok {
+		return false
+	}
+	_, ok := argumentsType[name]
+	return ok
+}
+
 func prepareArgumentsFromObject(arguments *jason.Object, argumentsType map[string]ArgumentType, readonlyFields map[string]struct{}) (query map[string]interface{}, err error) {
 	query = make(map[string]interface{})
 
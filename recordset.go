@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -755,6 +756,90 @@ func (f *JSONBArrayField) Accept(rs *RecordSet, visitor RecordSetVisitor) {
 	}
 }
 
+// EmbeddedField holds related records as JSON, visited as nested arrays and objects
+type EmbeddedField struct {
+	pgtype.JSON
+	Limit     int64 // maximum number of records of arrays, which hold one more record if truncated
+	Truncated bool  // true if the array of the last record visited was truncated
+}
+
+func (f *EmbeddedField) DbValue() interface{} {
+	return &f.JSON
+}
+
+func (f *EmbeddedField) Accept(rs *RecordSet, visitor RecordSetVisitor) {
+	if f.Status != pgtype.Present {
+		visitor.Null(rs)
+		return
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(f.JSON.Bytes))
+	decoder.UseNumber()
+
+	f.Truncated = false
+	if f.Limit <= 0 {
+		visitJsonValue(rs, visitor, decoder)
+		return
+	}
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		visitor.Null(rs)
+		return
+	}
+
+	visitor.BeginArray(rs, -1)
+	for n := int64(0); decoder.More(); n++ {
+		if n == f.Limit {
+			f.Truncated = true
+			break
+		}
+		visitJsonValue(rs, visitor, decoder)
+	}
+	visitor.EndArray(rs)
+}
+
+// visits the next JSON value of the decoder, keys of objects are visited as strings
+func visitJsonValue(rs *RecordSet, visitor RecordSetVisitor, decoder *json.Decoder) {
+	token, err := decoder.Token()
+	if err != nil {
+		return
+	}
+
+	switch v := token.(type) {
+	case json.Delim:
+		if v == '[' {
+			visitor.BeginArray(rs, -1)
+			for decoder.More() {
+				visitJsonValue(rs, visitor, decoder)
+			}
+			decoder.Token()
+			visitor.EndArray(rs)
+		} else {
+			visitor.BeginObject(rs)
+			for decoder.More() {
+				key, _ := decoder.Token()
+				name, _ := key.(string)
+				visitor.String(rs, name)
+				visitJsonValue(rs, visitor, decoder)
+			}
+			decoder.Token()
+			visitor.EndObject(rs)
+		}
+	case nil:
+		visitor.Null(rs)
+	case bool:
+		visitor.Bool(rs, v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			visitor.Integer(rs, i)
+		} else {
+			visitor.Numeric(rs, v.String())
+		}
+	case string:
+		visitor.String(rs, v)
+	}
+}
+
 type FieldBuilder func() Field
 
 var fieldsByOid map[uint32]FieldBuilder
@@ -797,17 +882,41 @@ func init() {
 }
 
 func readRecords(dst RecordSetVisitor, singleRow bool, rows pgx.Rows) error {
+	return readPageRecords(dst, singleRow, rows, nil, false, &PageBounds{})
+}
+
+// reads records like readRecords, counting them in bounds
+// embedded is the number of columns of embedded resources, following other columns
+// if keyset is true, the last column has cursor values of records, copied to bounds for the first and last records
+func readPageRecords(dst RecordSetVisitor, singleRow bool, rows pgx.Rows, embeddings []*Embedding, keyset bool, bounds *PageBounds) error {
 	rs := RecordSet{
 		Visitor:            dst,
 		Columns:            rows.FieldDescriptions(),
 		IncludeColumnNames: true,
 	}
 
+	var cursor pgtype.TextArray
+	if keyset {
+		rs.Columns = rs.Columns[:len(rs.Columns)-1]
+	}
+
 	count := len(rs.Columns)
 	fields := make([]Field, count)
-	values := make([]interface{}, count)
+	values := make([]interface{}, count, count+1)
+
+	embedded := make([]*EmbeddedField, len(embeddings))
 
 	for i := 0; i < count; i++ {
+		if j := i - (count - len(embeddings)); j >= 0 {
+			embedded[j] = &EmbeddedField{}
+			if embeddings[j].Key.ToMany {
+				embedded[j].Limit = embeddings[j].Route.MaxLimit
+			}
+			fields[i] = embedded[j]
+			values[i] = fields[i].DbValue()
+			continue
+		}
+
 		var found bool
 		var builder FieldBuilder
 		oid := rs.Columns[i].DataTypeOID
@@ -820,6 +929,10 @@ func readRecords(dst RecordSetVisitor, singleRow bool, rows pgx.Rows) error {
 		values[i] = fields[i].DbValue()
 	}
 
+	if keyset {
+		values = append(values, &cursor)
+	}
+
 	if !singleRow {
 		if err := rs.Visitor.BeginRecordSet(&rs); err != nil {
 			return err
@@ -835,13 +948,27 @@ func readRecords(dst RecordSetVisitor, singleRow bool, rows pgx.Rows) error {
 			return err
 		}
 
-		for i := 0; i < count; i++ {
-			fields[i].Accept(&rs, dst)
+		if err := rs.visitFields(fields); err != nil {
+			return err
+		}
+
+		for j, field := range embedded {
+			if field.Truncated && !bounds.isTruncated(embeddings[j].Alias) {
+				bounds.Truncated = append(bounds.Truncated, embeddings[j].Alias)
+			}
 		}
 
 		if err := rs.Visitor.EndRecord(&rs); err != nil {
 			return err
 		}
+
+		if keyset {
+			if bounds.Count == 0 {
+				bounds.First = cursor
+			}
+			bounds.Last = cursor
+		}
+		bounds.Count++
 	}
 
 	if err := rows.Err(); err != nil {
@@ -939,6 +1066,25 @@ func VisitRowsAffectedRecordSet(visitor RecordSetVisitor, rowsAffected int64) er
 	return nil
 }
 
+// visits values of current record, fields must match columns of the record set
+func (rs *RecordSet) visitFields(fields []Field) error {
+	for i, field := range fields {
+		rs.curCol = i
+
+		if err := rs.Visitor.BeginColumn(rs); err != nil {
+			return err
+		}
+
+		field.Accept(rs, rs.Visitor)
+
+		if err := rs.Visitor.EndColumn(rs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (rs *RecordSet) CurrentColumn() (int, *pgproto3.FieldDescription) {
 	return rs.curCol, &rs.Columns[rs.curCol]
 }
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/naoina/denco"
+)
+
+// PostgreSQL's epoch, used by timestamps of the streaming replication protocol
+var replicationEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ChangeFeed dispatches row changes decoded from a logical replication slot to subscribers of each relation
+type ChangeFeed struct {
+	mutex       sync.Mutex
+	subscribers map[pgtype.OID]map[*ChangeSubscriber]struct{}
+	relations   map[uint32]*ReplicatedRelation
+	buffer      []*ChangeEvent // most recent events, oldest first
+	bufferSize  int
+}
+
+type ChangeSubscriber struct {
+	Relation pgtype.OID
+	Events   chan *ChangeEvent
+}
+
+type ReplicatedRelation struct {
+	ID        uint32
+	Namespace string
+	Name      string
+	Columns   []pgproto3.FieldDescription
+}
+
+// changes are identified by the LSN of their transaction's commit, and their position in the transaction
+type ChangeEvent struct {
+	LSN      uint64
+	Sequence int
+	Kind     string // insert, update, delete, or truncate
+	Relation *ReplicatedRelation
+	Old      []Field // nil when not sent by PostgreSQL, unchanged TOASTed values are nil
+	New      []Field // nil when not sent by PostgreSQL, unchanged TOASTed values are nil
+}
+
+// true if this event follows given position in the replication stream
+func (e *ChangeEvent) After(lsn uint64, sequence int) bool {
+	return e.LSN > lsn || (e.LSN == lsn && e.Sequence > sequence)
+}
+
+func (e *ChangeEvent) Id() string {
+	return formatLSN(e.LSN) + ":" + strconv.Itoa(e.Sequence)
+}
+
+func NewChangeFeed(bufferSize int) *ChangeFeed {
+	return &ChangeFeed{
+		subscribers: make(map[pgtype.OID]map[*ChangeSubscriber]struct{}),
+		relations:   make(map[uint32]*ReplicatedRelation),
+		buffer:      make([]*ChangeEvent, 0, bufferSize),
+		bufferSize:  bufferSize,
+	}
+}
+
+// subscribes to changes of a relation, buffered events following given position are returned if resuming is possible
+func (feed *ChangeFeed) Subscribe(relation pgtype.OID, sinceLSN uint64, sinceSequence int) (s *ChangeSubscriber, missed []*ChangeEvent, resumed bool) {
+	s = &ChangeSubscriber{
+		Relation: relation,
+		Events:   make(chan *ChangeEvent, 64),
+	}
+
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	subscribers, ok := feed.subscribers[relation]
+	if !ok {
+		subscribers = make(map[*ChangeSubscriber]struct{})
+		feed.subscribers[relation] = subscribers
+	}
+	subscribers[s] = struct{}{}
+
+	if sinceLSN > 0 && len(feed.buffer) > 0 && !feed.buffer[0].After(sinceLSN, sinceSequence) {
+		resumed = true
+		for _, event := range feed.buffer {
+			if event.After(sinceLSN, sinceSequence) && pgtype.OID(event.Relation.ID) == relation {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	return
+}
+
+func (feed *ChangeFeed) Unsubscribe(s *ChangeSubscriber) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	feed.remove(s)
+}
+
+// forwards an event to subscribers of its relation, slow subscribers are dropped
+func (feed *ChangeFeed) Dispatch(event *ChangeEvent) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	if feed.bufferSize > 0 {
+		if len(feed.buffer) == feed.bufferSize {
+			copy(feed.buffer, feed.buffer[1:])
+			feed.buffer = feed.buffer[:len(feed.buffer)-1]
+		}
+		feed.buffer = append(feed.buffer, event)
+	}
+
+	for s := range feed.subscribers[pgtype.OID(event.Relation.ID)] {
+		select {
+		case s.Events <- event:
+		default:
+			log.Println("Subscriber too slow, dropped from changes of relation", event.Relation.Name)
+			feed.remove(s)
+		}
+	}
+}
+
+func (feed *ChangeFeed) remove(s *ChangeSubscriber) {
+	subscribers := feed.subscribers[s.Relation]
+	if _, ok := subscribers[s]; !ok {
+		return
+	}
+
+	delete(subscribers, s)
+	close(s.Events)
+
+	if len(subscribers) == 0 {
+		delete(feed.subscribers, s.Relation)
+	}
+}
+
+// consumes the replication slot, reconnecting on errors
+func (h *RequestHandler) replicate() {
+	go func() {
+		log.Println("Streaming changes from replication slot", h.ReplicationSlotName)
+		for atomic.LoadInt32(&h.stop) == 0 {
+			if err := h.streamChanges(context.Background()); err != nil {
+				log.Println("Replication stream interrupted:", err)
+			}
+
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+// opens a replication connection, and decodes changes sent by the pgoutput plugin until an error occurs
+func (h *RequestHandler) streamChanges(ctx context.Context) error {
+	config := h.DbConnConfig.Config.Copy()
+	if config.RuntimeParams == nil {
+		config.RuntimeParams = make(map[string]string)
+	}
+	config.RuntimeParams["replication"] = "database"
+
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	slot := quoteIdentifier(h.ReplicationSlotName)
+
+	if h.ReplicationTemporarySlot {
+		if _, err := conn.Exec(ctx, "CREATE_REPLICATION_SLOT "+slot+" TEMPORARY LOGICAL pgoutput NOEXPORT_SNAPSHOT").ReadAll(); err != nil {
+			return err
+		}
+	} else {
+		if _, err := conn.Exec(ctx, "CREATE_REPLICATION_SLOT "+slot+" LOGICAL pgoutput NOEXPORT_SNAPSHOT").ReadAll(); err != nil {
+			var pgErr *pgconn.PgError
+			// duplicate_object, the slot is kept between restarts
+			if !errors.As(err, &pgErr) || pgErr.Code != "42710" {
+				return err
+			}
+		}
+	}
+
+	// the publication name is a string literal in START_REPLICATION options
+	publication := strings.Replace(h.ReplicationPublicationName, `'`, `''`, -1)
+	startSql := "START_REPLICATION SLOT " + slot + " LOGICAL 0/0 (proto_version '1', publication_names '" + publication + "')"
+
+	if err := conn.SendBytes(ctx, (&pgproto3.Query{String: startSql}).Encode(nil)); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := msg.(*pgproto3.CopyBothResponse); ok {
+			break
+		}
+
+		if errMsg, ok := msg.(*pgproto3.ErrorResponse); ok {
+			return pgconn.ErrorResponseToPgError(errMsg)
+		}
+	}
+
+	decoder := changeDecoder{
+		Feed:     h.changes,
+		ConnInfo: pgtype.NewConnInfo(),
+	}
+
+	var flushedLSN uint64
+	nextStatus := time.Now()
+
+	for atomic.LoadInt32(&h.stop) == 0 {
+		if time.Now().After(nextStatus) {
+			if err := sendStandbyStatus(ctx, conn, flushedLSN); err != nil {
+				return err
+			}
+			nextStatus = time.Now().Add(10 * time.Second)
+		}
+
+		receiveContext, cancel := context.WithDeadline(ctx, nextStatus)
+		msg, err := conn.ReceiveMessage(receiveContext)
+		cancel()
+
+		if err != nil {
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			if len(msg.Data) == 0 {
+				continue
+			}
+
+			switch msg.Data[0] {
+			case 'k': // primary keepalive message
+				if len(msg.Data) < 18 {
+					return errors.New("Invalid keepalive message.")
+				}
+
+				if msg.Data[17] != 0 {
+					// reply requested
+					nextStatus = time.Now()
+				}
+			case 'w': // XLogData
+				if len(msg.Data) < 25 {
+					return errors.New("Invalid XLogData message.")
+				}
+
+				committed, err := decoder.Decode(msg.Data[25:])
+				if err != nil {
+					return err
+				}
+
+				if committed > 0 {
+					flushedLSN = committed
+				}
+			}
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		}
+	}
+
+	return nil
+}
+
+// reports to PostgreSQL how far changes were consumed, so it can free WAL files of the slot
+func sendStandbyStatus(ctx context.Context, conn *pgconn.PgConn, lsn uint64) error {
+	data := make([]byte, 34)
+	data[0] = 'r'
+	binary.BigEndian.PutUint64(data[1:], lsn)  // written
+	binary.BigEndian.PutUint64(data[9:], lsn)  // flushed
+	binary.BigEndian.PutUint64(data[17:], lsn) // applied
+	binary.BigEndian.PutUint64(data[25:], uint64(time.Since(replicationEpoch)/time.Microsecond))
+	data[33] = 0
+
+	return conn.SendBytes(ctx, (&pgproto3.CopyData{Data: data}).Encode(nil))
+}
+
+// decodes messages of the pgoutput logical decoding plugin, protocol version 1
+type changeDecoder struct {
+	Feed     *ChangeFeed
+	ConnInfo *pgtype.ConnInfo
+
+	buf      *bytes.Reader
+	err      error
+	lsn      uint64 // LSN of the commit of current transaction
+	sequence int    // number of changes seen in current transaction
+}
+
+// decodes one message, returns the end LSN of a transaction when committed, zero otherwise
+func (d *changeDecoder) Decode(data []byte) (uint64, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	d.buf = bytes.NewReader(data[1:])
+	d.err = nil
+
+	var committed uint64
+
+	switch data[0] {
+	case 'B': // begin
+		d.lsn = d.uint64()
+		d.sequence = 0
+	case 'C': // commit
+		d.uint8()  // flags
+		d.uint64() // LSN of commit
+		committed = d.uint64()
+	case 'R': // relation
+		relation := &ReplicatedRelation{ID: d.uint32()}
+		relation.Namespace = d.string()
+		relation.Name = d.string()
+		d.uint8() // replica identity
+		count := int(d.uint16())
+		relation.Columns = make([]pgproto3.FieldDescription, 0, count)
+		for i := 0; i < count && d.err == nil; i++ {
+			d.uint8() // flags
+			name := d.string()
+			oid := d.uint32()
+			typeModifier := int32(d.uint32())
+			relation.Columns = append(relation.Columns, pgproto3.FieldDescription{
+				Name:         []byte(name),
+				DataTypeOID:  oid,
+				TypeModifier: typeModifier,
+			})
+		}
+		if d.err == nil {
+			d.Feed.mutex.Lock()
+			d.Feed.relations[relation.ID] = relation
+			d.Feed.mutex.Unlock()
+		}
+	case 'I': // insert
+		event := d.event("insert")
+		if d.uint8() == 'N' {
+			event.New = d.tuple(event.Relation)
+		}
+		d.dispatch(event)
+	case 'U': // update
+		event := d.event("update")
+		switch d.uint8() {
+		case 'K', 'O':
+			event.Old = d.tuple(event.Relation)
+			if d.uint8() == 'N' {
+				event.New = d.tuple(event.Relation)
+			}
+		case 'N':
+			event.New = d.tuple(event.Relation)
+		}
+		d.dispatch(event)
+	case 'D': // delete
+		event := d.event("delete")
+		switch d.uint8() {
+		case 'K', 'O':
+			event.Old = d.tuple(event.Relation)
+		}
+		d.dispatch(event)
+	case 'T': // truncate
+		count := int(d.uint32())
+		d.uint8() // options
+		for i := 0; i < count && d.err == nil; i++ {
+			relation := d.relation(d.uint32())
+			if relation != nil {
+				d.dispatch(&ChangeEvent{LSN: d.lsn, Sequence: d.sequence, Kind: "truncate", Relation: relation})
+				d.sequence++
+			}
+		}
+	}
+
+	return committed, d.err
+}
+
+func (d *changeDecoder) event(kind string) *ChangeEvent {
+	event := &ChangeEvent{
+		LSN:      d.lsn,
+		Sequence: d.sequence,
+		Kind:     kind,
+		Relation: d.relation(d.uint32()),
+	}
+
+	d.sequence++
+
+	return event
+}
+
+func (d *changeDecoder) relation(id uint32) *ReplicatedRelation {
+	d.Feed.mutex.Lock()
+	defer d.Feed.mutex.Unlock()
+
+	relation, ok := d.Feed.relations[id]
+	if !ok && d.err == nil {
+		d.err = fmt.Errorf("Unknown relation in replication stream: %d", id)
+	}
+
+	return relation
+}
+
+func (d *changeDecoder) dispatch(event *ChangeEvent) {
+	if d.err == nil {
+		d.Feed.Dispatch(event)
+	}
+}
+
+// decodes values of a row, sent in text format by pgoutput
+func (d *changeDecoder) tuple(relation *ReplicatedRelation) []Field {
+	count := int(d.uint16())
+	if d.err != nil || relation == nil {
+		return nil
+	}
+
+	if count != len(relation.Columns) {
+		d.err = errors.New("Invalid tuple in replication stream.")
+		return nil
+	}
+
+	fields := make([]Field, count)
+
+	for i := 0; i < count && d.err == nil; i++ {
+		switch d.uint8() {
+		case 'n': // null
+			field := newFieldByOid(relation.Columns[i].DataTypeOID)
+			if decoder, ok := field.DbValue().(pgtype.TextDecoder); ok {
+				decoder.DecodeText(d.ConnInfo, nil)
+			}
+			fields[i] = field
+		case 'u': // unchanged TOASTed value, not sent
+			fields[i] = nil
+		case 't':
+			size := int(d.uint32())
+			if d.err != nil {
+				break
+			}
+
+			data := make([]byte, size)
+			if _, err := io.ReadFull(d.buf, data); err != nil {
+				d.err = err
+				break
+			}
+
+			field := newFieldByOid(relation.Columns[i].DataTypeOID)
+			if decoder, ok := field.DbValue().(pgtype.TextDecoder); ok {
+				if err := decoder.DecodeText(d.ConnInfo, data); err != nil {
+					d.err = err
+				}
+			}
+			fields[i] = field
+		}
+	}
+
+	return fields
+}
+
+func (d *changeDecoder) uint8() byte {
+	b, err := d.buf.ReadByte()
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return b
+}
+
+func (d *changeDecoder) uint16() uint16 {
+	var v uint16
+	if err := binary.Read(d.buf, binary.BigEndian, &v); err != nil && d.err == nil {
+		d.err = err
+	}
+	return v
+}
+
+func (d *changeDecoder) uint32() uint32 {
+	var v uint32
+	if err := binary.Read(d.buf, binary.BigEndian, &v); err != nil && d.err == nil {
+		d.err = err
+	}
+	return v
+}
+
+func (d *changeDecoder) uint64() uint64 {
+	var v uint64
+	if err := binary.Read(d.buf, binary.BigEndian, &v); err != nil && d.err == nil {
+		d.err = err
+	}
+	return v
+}
+
+func (d *changeDecoder) string() string {
+	var s strings.Builder
+	for {
+		b, err := d.buf.ReadByte()
+		if err != nil {
+			if d.err == nil {
+				d.err = err
+			}
+			break
+		}
+		if b == 0 {
+			break
+		}
+		s.WriteByte(b)
+	}
+	return s.String()
+}
+
+// makes a field for given type, types unknown to pgasus are kept as text
+func newFieldByOid(oid uint32) Field {
+	if builder, found := fieldsByOid[oid]; found {
+		return builder()
+	}
+	return &TextField{}
+}
+
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
+
+// parses the ID of an event, or a LSN alone to skip whole transactions up to this LSN
+func parseChangeEventId(s string) (uint64, int, error) {
+	sequence := math.MaxInt32
+
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		var err error
+		if sequence, err = strconv.Atoi(s[i+1:]); err != nil {
+			return 0, 0, err
+		}
+		s = s[:i]
+	}
+
+	lsn, err := parseLSN(s)
+	return lsn, sequence, err
+}
+
+func parseLSN(s string) (uint64, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, errors.New("Invalid LSN: " + s)
+	}
+
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return hi<<32 | lo, nil
+}
+
+// makes a request handler streaming changes of a relation as Server-Sent Events when the events format is requested
+func (h *RequestHandler) makeRealtimeRouteHandler(route *Route, next denco.HandlerFunc) denco.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params denco.Params) {
+		if r.Header.Get("X-Accept-Extension") != "events" {
+			next(w, r, params)
+			return
+		}
+
+		ctx := r.Context()
+
+		// changes are only matched against variables and constants of the route
+		if h.FilterQueryName != "" && r.URL.Query().Get(h.FilterQueryName) != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Filters unsupported on streams of changes."))
+			return
+		}
+
+		globalQuery := initGlobalQuery(route)
+		if err := paramsDecoder(globalQuery, params, route.ParametersTypes); err != nil {
+			panic(err)
+		}
+
+		// clients resume from the ID of the last event received
+		var sinceLSN uint64
+		var sinceSequence int
+		if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+			var err error
+			if sinceLSN, sinceSequence, err = parseChangeEventId(lastEventId); err != nil {
+				panic(err)
+			}
+		} else if lsn := r.URL.Query().Get("lsn"); lsn != "" {
+			var err error
+			if sinceLSN, sinceSequence, err = parseChangeEventId(lsn); err != nil {
+				panic(err)
+			}
+		}
+
+		tx, err := h.beginRequestTx(ctx, r, route, params)
+		if err != nil {
+			panic(err)
+		}
+		defer tx.Rollback(ctx)
+
+		var granted bool
+		if err := tx.QueryRow(ctx, `SELECT has_table_privilege($1::oid, 'SELECT')`, route.RelationOid).Scan(&granted); err != nil {
+			panic(err)
+		}
+
+		if !granted {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Access to relation denied."))
+			return
+		}
+
+		if err := h.commitRequestTx(ctx, w, tx); err != nil {
+			panic(err)
+		}
+
+		subscriber, missed, resumed := h.changes.Subscribe(route.RelationOid, sinceLSN, sinceSequence)
+		defer h.changes.Unsubscribe(subscriber)
+
+		stream, err := OpenEventStream(w, r)
+		if err != nil {
+			panic(err)
+		}
+		defer stream.Close()
+
+		if sinceLSN > 0 && !resumed {
+			// changes were missed, the client has to reload the relation
+			if err := stream.Send("", "reset", ""); err != nil {
+				return
+			}
+		}
+
+		for _, event := range missed {
+			if err := h.sendChangeEvent(stream, route, globalQuery, event); err != nil {
+				return
+			}
+		}
+
+		keepAlive, stopKeepAlive := keepAliveTicker(h.EventStreamKeepAliveSecs)
+		defer stopKeepAlive()
+
+		for {
+			select {
+			case <-stream.Done():
+				return
+			case <-keepAlive:
+				if err := stream.KeepAlive(); err != nil {
+					return
+				}
+			case event, ok := <-subscriber.Events:
+				if !ok {
+					// subscriber was dropped, the client will reconnect
+					return
+				}
+
+				if err := h.sendChangeEvent(stream, route, globalQuery, event); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// sends a change as JSON, without hidden fields, if it matches variables and constants of the route
+func (h *RequestHandler) sendChangeEvent(stream *EventStream, route *Route, globalQuery map[string]interface{}, event *ChangeEvent) error {
+	if event.Kind != "truncate" {
+		row := event.New
+		if row == nil {
+			row = event.Old
+		}
+
+		if !changeMatchesQuery(event.Relation, row, globalQuery) {
+			return nil
+		}
+	}
+
+	w := NewJsonRecordSetWriter(h.MaxResponseSizeKbytes << 10)
+
+	if err := w.BeginObject(nil); err != nil {
+		return err
+	}
+
+	if event.Old != nil {
+		w.String(nil, "old")
+		if err := visitChangedRow(w, route, event.Relation, event.Old); err != nil {
+			return err
+		}
+	}
+
+	if event.New != nil {
+		w.String(nil, "new")
+		if err := visitChangedRow(w, route, event.Relation, event.New); err != nil {
+			return err
+		}
+	}
+
+	if err := w.EndObject(nil); err != nil {
+		return err
+	}
+
+	return stream.Send(event.Id(), event.Kind, string(w.ToBytes()))
+}
+
+func visitChangedRow(visitor RecordSetVisitor, route *Route, relation *ReplicatedRelation, row []Field) error {
+	rs := RecordSet{
+		Visitor:            visitor,
+		Columns:            make([]pgproto3.FieldDescription, 0, len(row)),
+		IncludeColumnNames: true,
+	}
+
+	fields := make([]Field, 0, len(row))
+
+	for i, field := range row {
+		name := string(relation.Columns[i].Name)
+		if _, hidden := route.HiddenFields[name]; hidden || field == nil {
+			continue
+		}
+
+		rs.Columns = append(rs.Columns, relation.Columns[i])
+		fields = append(fields, field)
+	}
+
+	if err := rs.Visitor.BeginRecord(&rs); err != nil {
+		return err
+	}
+
+	if err := rs.visitFields(fields); err != nil {
+		return err
+	}
+
+	return rs.Visitor.EndRecord(&rs)
+}
+
+// checks columns of a row against equality conditions, columns not sent by PostgreSQL never match
+func changeMatchesQuery(relation *ReplicatedRelation, row []Field, query map[string]interface{}) bool {
+	for name, expected := range query {
+		matched := false
+
+		for i, column := range relation.Columns {
+			if string(column.Name) != name {
+				continue
+			}
+
+			if i >= len(row) || row[i] == nil {
+				break
+			}
+
+			actual, ok := row[i].DbValue().(pgtype.Value)
+			if !ok {
+				break
+			}
+
+			if expected == nil {
+				matched = actual.Get() == nil
+				break
+			}
+
+			converted, ok := newFieldByOid(column.DataTypeOID).DbValue().(pgtype.Value)
+			if !ok || converted.Set(expected) != nil {
+				break
+			}
+
+			if t, ok := actual.Get().(time.Time); ok {
+				u, ok := converted.Get().(time.Time)
+				matched = ok && t.Equal(u)
+			} else {
+				matched = reflect.DeepEqual(actual.Get(), converted.Get())
+			}
+			break
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
@@ -18,6 +18,17 @@ type Schema struct {
 	CookiesPath          string
 	CookiesDisableSecure bool
 	RoutesTableName      string
+	StrictRoutes         bool // all routes must be valid to be loaded
+}
+
+// RouteError reports why a route could not be loaded
+type RouteError struct {
+	Route *Route
+	Err   error
+}
+
+func (e *RouteError) Error() string {
+	return fmt.Sprintf("route %d, %s %s: %v", e.Route.RouteID, strings.ToUpper(e.Route.Method), e.Route.UrlPath, e.Err)
 }
 
 type ArgumentType struct {
@@ -47,6 +58,27 @@ type Route struct {
 	SelectedColumns      string                   // relations only
 	ContextInputCookies  map[string]*CookieConfig // cookies to get from HTTP requests
 	ContextOutputCookies []*CookieConfig          // cookies to set in HTTP responses
+	ChannelProcedure     string                   // channels only, stable procedure checking access to channel and payloads
+	ChannelFilter        bool                     // channels only, true if each payload is checked by ChannelProcedure
+	Realtime             bool                     // get on relations only, true if changes can be streamed
+	Async                bool                     // procedures only, true if executed in background as a job
+	LargeObject          bool                     // procedures only, true if a large object is streamed from its result, or to its oid argument
+	RelationOid          pgtype.OID               // relations only
+	ContentColumn        string                   // get on relations only, bytea column downloaded as a file
+	ContentTypeColumn    string                   // get on relations only, column with MIME type of downloaded file
+	FilenameColumn       string                   // get on relations only, column with filename of downloaded file
+	MaintenanceExempt    bool                     // true if available during maintenance
+	CsrfProtection       string                   // none, double_submit, or origin, global protection if empty
+	AllowedRoles         []string                 // roles of clients allowed, all roles if empty
+	RequiredScopes       []string                 // scopes of tokens or API keys required
+	HooksExempt          bool                     // true if pre-request and post-request procedures are not called
+	AuditReads           bool                     // get routes only, true if audited
+	AuditRedactedFields  map[string]struct{}      // fields of request bodies redacted in audit entries
+	CursorColumn         string                   // get on relations only, unique column enabling keyset pagination
+	Aggregation          bool                     // get on relations only, true if records can be grouped and aggregated
+	MaxGroups            int64                    // get on relations only, maximum number of groups returned
+	ForeignKeys          []*ForeignKey            // get on relations only, foreign keys of related resources that can be embedded
+	NotNullFields        map[string]struct{}      // relations only, columns with a NOT NULL constraint, usable as keyset sort keys
 	// for documentation generator:
 	RouteID             int
 	AllCookies          []CookieConfig
@@ -86,26 +118,28 @@ func (s *NullString) UnmarshalJSON(raw []byte) error {
 }
 
 // loads all routes defined in PostgreSQL
-func (s *Schema) LoadRoutes(ctx context.Context, tx pgx.Tx, searchPath string) ([]*Route, error) {
+// invalid routes are skipped and reported, unless in strict mode where the first one is returned as error
+func (s *Schema) LoadRoutes(ctx context.Context, tx pgx.Tx, searchPath string) ([]*Route, []*RouteError, error) {
 	log.Println("Loading routes...")
 
 	if searchPath != "" {
 		if strings.Index(searchPath, ";") >= 0 {
-			return nil, errors.New("Invalid search path: " + searchPath)
+			return nil, nil, errors.New("Invalid search path: " + searchPath)
 		}
 
 		if _, err := tx.Exec(ctx, `SET LOCAL search_path = `+searchPath); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	rows, err := tx.Query(ctx, `SELECT route_id,method,url_path,object_name,object_type,ttl,is_public,hidden_fields,readonly_fields,context_mapped_headers,context_mapped_variables,constants,max_limit,context_mapped_cookies FROM `+quoteIdentifier(s.RoutesTableName)+` ORDER BY url_path, CASE method WHEN 'get' THEN 0 WHEN 'post' THEN 1 WHEN 'put' THEN 2 ELSE 9 END`)
+	rows, err := tx.Query(ctx, `SELECT route_id,method,url_path,object_name,object_type,ttl,is_public,hidden_fields,readonly_fields,context_mapped_headers,context_mapped_variables,constants,max_limit,context_mapped_cookies,channel_procedure,channel_filter,realtime,async,large_object,content_column,content_type_column,filename_column,maintenance_exempt,csrf_protection,allowed_roles,required_scopes,hooks_exempt,audit_reads,audit_redacted_fields,cursor_column,aggregation,max_groups FROM `+quoteIdentifier(s.RoutesTableName)+` ORDER BY url_path, CASE method WHEN 'get' THEN 0 WHEN 'post' THEN 1 WHEN 'put' THEN 2 ELSE 9 END`)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer rows.Close()
 
 	routes := make([]*Route, 0, 16)
+	var routeErrors []*RouteError
 	for rows.Next() {
 		r := new(Route)
 
@@ -114,12 +148,25 @@ func (s *Schema) LoadRoutes(ctx context.Context, tx pgx.Tx, searchPath string) (
 		var hiddenFields []string
 		var readonlyFields []string
 		var rawCookiesJson []byte
-		if err := rows.Scan(&r.RouteID, &r.Method, &r.UrlPath, &r.ObjectName, &r.ObjectType, &ttl, &r.IsPublic, &hiddenFields, &readonlyFields, &r.ContextHeaders, &r.ContextParameters, &r.RawConstants, &maxLimit, &rawCookiesJson); err != nil {
-			return nil, err
+		var channelProcedure pgtype.Text
+		var contentColumn, contentTypeColumn, filenameColumn pgtype.Text
+		var csrfProtection pgtype.Text
+		var auditRedactedFields []string
+		var cursorColumn pgtype.Text
+		var maxGroups pgtype.Int4
+		if err := rows.Scan(&r.RouteID, &r.Method, &r.UrlPath, &r.ObjectName, &r.ObjectType, &ttl, &r.IsPublic, &hiddenFields, &readonlyFields, &r.ContextHeaders, &r.ContextParameters, &r.RawConstants, &maxLimit, &rawCookiesJson, &channelProcedure, &r.ChannelFilter, &r.Realtime, &r.Async, &r.LargeObject, &contentColumn, &contentTypeColumn, &filenameColumn, &r.MaintenanceExempt, &csrfProtection, &r.AllowedRoles, &r.RequiredScopes, &r.HooksExempt, &r.AuditReads, &auditRedactedFields, &cursorColumn, &r.Aggregation, &maxGroups); err != nil {
+			return nil, nil, err
 		}
 
 		r.TTL = int(ttl)
 		r.MaxLimit = int64(maxLimit)
+		r.ChannelProcedure = channelProcedure.String
+		r.ContentColumn = contentColumn.String
+		r.ContentTypeColumn = contentTypeColumn.String
+		r.FilenameColumn = filenameColumn.String
+		r.CsrfProtection = csrfProtection.String
+		r.CursorColumn = cursorColumn.String
+		r.MaxGroups = int64(maxGroups.Int)
 
 		r.HiddenFields = make(map[string]struct{})
 		for _, hiddenField := range hiddenFields {
@@ -131,9 +178,20 @@ func (s *Schema) LoadRoutes(ctx context.Context, tx pgx.Tx, searchPath string) (
 			r.ReadOnlyFields[readonlyField] = struct{}{}
 		}
 
+		r.AuditRedactedFields = make(map[string]struct{})
+		for _, redactedField := range auditRedactedFields {
+			r.AuditRedactedFields[redactedField] = struct{}{}
+		}
+
 		if rawCookiesJson != nil {
 			if err := json.Unmarshal(rawCookiesJson, &r.AllCookies); err != nil {
-				return nil, errors.New(fmt.Sprintf("Could not parse cookies configuration for %v %v, error: %v", r.Method, r.UrlPath, err.Error()))
+				routeError := &RouteError{Route: r, Err: errors.New("Could not parse cookies configuration: " + err.Error())}
+				if s.StrictRoutes {
+					return nil, []*RouteError{routeError}, routeError
+				}
+
+				routeErrors = append(routeErrors, routeError)
+				continue
 			}
 
 			r.ContextInputCookies = make(map[string]*CookieConfig)
@@ -178,21 +236,64 @@ func (s *Schema) LoadRoutes(ctx context.Context, tx pgx.Tx, searchPath string) (
 		routes = append(routes, r)
 	}
 
-	for _, r := range routes {
-		if err := loadObject(ctx, tx, r); err != nil {
-			return nil, err
-		}
+	valid := make([]*Route, 0, len(routes))
 
-		if r.ObjectType == "procedure" {
-			if err := loadProc(ctx, tx, r); err != nil {
-				return nil, err
+	for _, r := range routes {
+		if err := loadRoute(ctx, tx, r); err != nil {
+			routeError := &RouteError{Route: r, Err: err}
+			if s.StrictRoutes {
+				return nil, []*RouteError{routeError}, routeError
 			}
+
+			routeErrors = append(routeErrors, routeError)
+			continue
 		}
+
+		valid = append(valid, r)
 	}
 
 	log.Println("Routes loaded.")
 
-	return routes, nil
+	return valid, routeErrors, nil
+}
+
+// loads definition of route's object in a savepoint, so that errors don't abort the transaction
+func loadRoute(ctx context.Context, tx pgx.Tx, r *Route) error {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer savepoint.Rollback(ctx)
+
+	if err := loadObject(ctx, savepoint, r); err != nil {
+		return err
+	}
+
+	if r.ObjectType == "relation" && r.Method == "get" {
+		if err := loadForeignKeys(ctx, savepoint, r); err != nil {
+			return err
+		}
+	}
+
+	if r.ObjectType == "procedure" {
+		if err := loadProc(ctx, savepoint, r); err != nil {
+			return err
+		}
+	}
+
+	if r.ObjectType == "channel" && r.ChannelProcedure != "" {
+		if err := checkChannelProc(ctx, savepoint, r); err != nil {
+			return err
+		}
+	}
+
+	if r.ObjectType == "relation" && r.Realtime {
+		if err := checkRealtimeRelation(ctx, savepoint, r); err != nil {
+			return err
+		}
+	}
+
+	return savepoint.Commit(ctx)
 }
 
 // loads types of relation columns or procedure arguments from PostgreSQL for given route
@@ -207,15 +308,21 @@ func loadObject(ctx context.Context, tx pgx.Tx, route *Route) error {
 		if err != nil {
 			return err
 		}
-		sql := `SELECT att.attname, coalesce(etyp.oid, 0), (CASE coalesce(etyp.typtype, typ.typtype) WHEN 'b' THEN att.atttypid::regtype::text WHEN 'd' THEN coalesce(etyp.typbasetype::regtype::text || '[]', typ.typbasetype::regtype::text) ELSE (CASE WHEN typ.typcategory = 'A' THEN 25::regtype::text || '[]' ELSE 25::regtype::text END) END), typ.oid::regtype, att.atthasdef OR NOT att.attnotnull FROM pg_attribute att INNER JOIN pg_type typ ON att.atttypid = typ.oid LEFT JOIN pg_type etyp ON typ.typelem = etyp.oid AND typ.typcategory = 'A' WHERE att.attrelid = $1 AND att.attisdropped = false AND att.attnum > 0`
+		route.RelationOid = oid
+		sql := `SELECT att.attname, coalesce(etyp.oid, 0), (CASE coalesce(etyp.typtype, typ.typtype) WHEN 'b' THEN att.atttypid::regtype::text WHEN 'd' THEN coalesce(etyp.typbasetype::regtype::text || '[]', typ.typbasetype::regtype::text) ELSE (CASE WHEN typ.typcategory = 'A' THEN 25::regtype::text || '[]' ELSE 25::regtype::text END) END), typ.oid::regtype, att.atthasdef OR NOT att.attnotnull, att.attnotnull FROM pg_attribute att INNER JOIN pg_type typ ON att.atttypid = typ.oid LEFT JOIN pg_type etyp ON typ.typelem = etyp.oid AND typ.typcategory = 'A' WHERE att.attrelid = $1 AND att.attisdropped = false AND att.attnum > 0`
 		rows, err = tx.Query(ctx, sql, oid)
 	case "procedure":
 		oid, err = getProcedureOid(ctx, tx, route.ObjectName)
 		if err != nil {
 			return err
 		}
-		sql := `SELECT args.name, coalesce(etyp.oid, 0), (CASE coalesce(etyp.typtype, typ.typtype) WHEN 'b' THEN args.type::regtype::text WHEN 'd' THEN coalesce(etyp.typbasetype::regtype::text || '[]', typ.typbasetype::regtype::text) ELSE (CASE WHEN typ.typcategory = 'A' THEN 25::regtype::text || '[]' ELSE 25::regtype::text END) END), typ.oid::regtype, isoptional FROM (SELECT (row_number() OVER ()) BETWEEN (pg_proc.pronargs-pg_proc.pronargdefaults+1) AND pg_proc.pronargs, unnest.* FROM pg_proc, unnest(pg_proc.proargnames, pg_proc.proargtypes::int[]) WHERE pg_proc.oid = $1) AS args(isoptional, name, type) INNER JOIN pg_type typ ON args.type = typ.oid LEFT JOIN pg_type etyp ON typ.typelem = etyp.oid AND typ.typcategory = 'A'`
+		sql := `SELECT args.name, coalesce(etyp.oid, 0), (CASE coalesce(etyp.typtype, typ.typtype) WHEN 'b' THEN args.type::regtype::text WHEN 'd' THEN coalesce(etyp.typbasetype::regtype::text || '[]', typ.typbasetype::regtype::text) ELSE (CASE WHEN typ.typcategory = 'A' THEN 25::regtype::text || '[]' ELSE 25::regtype::text END) END), typ.oid::regtype, isoptional, false FROM (SELECT (row_number() OVER ()) BETWEEN (pg_proc.pronargs-pg_proc.pronargdefaults+1) AND pg_proc.pronargs, unnest.* FROM pg_proc, unnest(pg_proc.proargnames, pg_proc.proargtypes::int[]) WHERE pg_proc.oid = $1) AS args(isoptional, name, type) INNER JOIN pg_type typ ON args.type = typ.oid LEFT JOIN pg_type etyp ON typ.typelem = etyp.oid AND typ.typcategory = 'A'`
 		rows, err = tx.Query(ctx, sql, oid)
+	case "channel":
+		// notification channels have neither columns nor arguments
+		route.ParametersTypes = make(map[string]ArgumentType)
+		route.ParametersDeclTypes = make(map[string]string)
+		return nil
 	default:
 		return errors.New("Unknown object type: " + route.ObjectType)
 	}
@@ -227,14 +334,15 @@ func loadObject(ctx context.Context, tx pgx.Tx, route *Route) error {
 
 	route.ParametersTypes = make(map[string]ArgumentType)
 	route.ParametersDeclTypes = make(map[string]string)
+	route.NotNullFields = make(map[string]struct{})
 	fieldsLeft := make([]string, 0, 16)
 	optionalArguments := make([]string, 0, 16)
 
 	for rows.Next() {
 		var name, typ, declTyp pgtype.Text
 		var eoid pgtype.OID
-		var isoptional bool
-		if err := rows.Scan(&name, &eoid, &typ, &declTyp, &isoptional); err != nil {
+		var isoptional, notnull bool
+		if err := rows.Scan(&name, &eoid, &typ, &declTyp, &isoptional, &notnull); err != nil {
 			return err
 		}
 
@@ -242,6 +350,10 @@ func loadObject(ctx context.Context, tx pgx.Tx, route *Route) error {
 			route.ParametersTypes[name.String] = ArgumentType{Name: typ.String, ElementOid: eoid}
 
 			if route.ObjectType == "relation" {
+				if notnull {
+					route.NotNullFields[name.String] = struct{}{}
+				}
+
 				if _, ok := route.HiddenFields[name.String]; !ok {
 					fieldsLeft = append(fieldsLeft, quoteIdentifier(name.String))
 				}
@@ -264,6 +376,18 @@ func loadObject(ctx context.Context, tx pgx.Tx, route *Route) error {
 	}
 
 	route.SelectedColumns = strings.Join(fieldsLeft, ",")
+
+	if route.CursorColumn != "" {
+		if _, ok := route.ParametersTypes[route.CursorColumn]; !ok || route.ObjectType != "relation" {
+			return errors.New("Cursor column " + route.CursorColumn + " not found in relation.")
+		}
+		if _, hidden := route.HiddenFields[route.CursorColumn]; hidden {
+			return errors.New("Cursor column " + route.CursorColumn + " can't be hidden.")
+		}
+		if _, ok := route.NotNullFields[route.CursorColumn]; !ok {
+			return errors.New("Cursor column " + route.CursorColumn + " must be NOT NULL.")
+		}
+	}
 	route.OptionalArguments = optionalArguments
 
 	if route.Description, err = getDescription(ctx, tx, oid); err != nil {
@@ -292,6 +416,43 @@ func loadProc(ctx context.Context, tx pgx.Tx, route *Route) error {
 	return nil
 }
 
+// checks that the procedure of a channel exists and is immutable or stable
+func checkChannelProc(ctx context.Context, tx pgx.Tx, route *Route) error {
+	oid, err := getProcedureOid(ctx, tx, route.ChannelProcedure)
+	if err != nil {
+		return err
+	}
+
+	var provolatile rune
+	if err := tx.QueryRow(ctx, `SELECT provolatile FROM pg_proc WHERE oid = $1`, oid).Scan(&provolatile); err != nil {
+		return err
+	}
+
+	if provolatile != 'i' && provolatile != 's' {
+		return errors.New("Procedure '" + route.ChannelProcedure + "' must be immutable or stable for use in channel routes.")
+	}
+
+	return nil
+}
+
+// checks that a realtime relation has neither row security nor column privileges
+// changes are decoded from the WAL, so policies and column grants of subscribers can't be applied to them
+func checkRealtimeRelation(ctx context.Context, tx pgx.Tx, route *Route) error {
+	var rowSecurity, columnGrants bool
+	if err := tx.QueryRow(ctx, `SELECT rel.relrowsecurity, EXISTS (SELECT 1 FROM pg_attribute att WHERE att.attrelid = rel.oid AND att.attnum > 0 AND att.attisdropped = false AND att.attacl IS NOT NULL) FROM pg_class rel WHERE rel.oid = $1`, route.RelationOid).Scan(&rowSecurity, &columnGrants); err != nil {
+		return err
+	}
+
+	if rowSecurity {
+		return errors.New("Realtime relation '" + route.ObjectName + "' can't have row level security.")
+	}
+	if columnGrants {
+		return errors.New("Realtime relation '" + route.ObjectName + "' can't have column privileges.")
+	}
+
+	return nil
+}
+
 func getRelationOid(ctx context.Context, tx pgx.Tx, id string) (pgtype.OID, error) {
 	rows, err := tx.Query(ctx, `SELECT $1::regclass::oid`, id)
 	if err != nil {
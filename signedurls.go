@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// query parameters of signed URLs
+const (
+	signedUrlExpiresParameter   = "expires"
+	signedUrlSignatureParameter = "signature"
+	signedUrlContextPrefix      = "context." // followed by the name of a context variable
+)
+
+// returns the string covered by the signature, the signature parameter is excluded, other parameters are sorted by name
+func canonicalSignedUrl(method string, path string, query url.Values) string {
+	q := make(url.Values, len(query))
+	for name, values := range query {
+		if name != signedUrlSignatureParameter {
+			q[name] = values
+		}
+	}
+
+	return strings.ToUpper(method) + "\n" + path + "\n" + q.Encode()
+}
+
+func signUrl(key []byte, method string, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(canonicalSignedUrl(method, path, query)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// makes a signed URL, context values are bound to the URL and can't be changed by its holder
+func makeSignedUrl(key []byte, method string, rawUrl string, expires time.Time, context map[string]string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Set(signedUrlExpiresParameter, strconv.FormatInt(expires.Unix(), 10))
+	for name, value := range context {
+		query.Set(signedUrlContextPrefix+name, value)
+	}
+	query.Set(signedUrlSignatureParameter, signUrl(key, method, u.Path, query))
+
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// authenticates signed URLs, the identity is attached to the returned request, and parameters of the signature are removed
+// invalid or expired signatures are answered with a 403 status code, and a nil request is returned
+func (h *RequestHandler) authenticateSignedUrl(w http.ResponseWriter, r *http.Request, path string) *http.Request {
+	query := r.URL.Query()
+	if _, ok := query[signedUrlSignatureParameter]; !ok {
+		return r
+	}
+
+	identity, err := h.verifySignedUrl(r.Method, path, query)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return nil
+	}
+
+	for name := range query {
+		if name == signedUrlSignatureParameter || name == signedUrlExpiresParameter || strings.HasPrefix(name, signedUrlContextPrefix) {
+			query.Del(name)
+		}
+	}
+	r.URL.RawQuery = query.Encode()
+
+	return r.WithContext(context.WithValue(r.Context(), tokenIdentityKey{}, identity))
+}
+
+func (h *RequestHandler) verifySignedUrl(method string, path string, query url.Values) (*TokenIdentity, error) {
+	expected := signUrl([]byte(h.SignedUrlsKey), method, path, query)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(signedUrlSignatureParameter))) {
+		return nil, errors.New("Invalid signature.")
+	}
+
+	expires, err := strconv.ParseInt(query.Get(signedUrlExpiresParameter), 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid expiration of signature.")
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return nil, errors.New("Signature expired.")
+	}
+
+	identity := &TokenIdentity{
+		Role:    h.SignedUrlsRole,
+		Context: make(map[string]string),
+	}
+
+	for name, value := range h.SignedUrlsContext {
+		identity.Context[name] = value
+	}
+	for name := range query {
+		if strings.HasPrefix(name, signedUrlContextPrefix) {
+			identity.Context[name[len(signedUrlContextPrefix):]] = query.Get(name)
+		}
+	}
+
+	return identity, nil
+}
+
+// prints a signed URL, the path must include the URL prefix and the extension
+func signUrlCommand(handler RequestHandler, method string, rawUrl string, expiresIn time.Duration, context map[string]string) {
+	if handler.SignedUrlsKey == "" {
+		log.Fatalln("No key to sign URLs.")
+	}
+
+	signed, err := makeSignedUrl([]byte(handler.SignedUrlsKey), method, rawUrl, time.Now().Add(expiresIn), context)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Println(signed)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignUrl(t *testing.T) {
+	// other implementations must sign the same canonical string: method, path, and sorted parameters
+	query := url.Values{"b": {"2"}, "a": {"1"}, "expires": {"1700000000"}, "signature": {"ignored"}}
+
+	if canonical := canonicalSignedUrl("get", "/api/files/1.pdf", query); canonical != "GET\n/api/files/1.pdf\na=1&b=2&expires=1700000000" {
+		t.Errorf("unexpected canonical string %q", canonical)
+	}
+
+	if signature := signUrl([]byte("key"), "get", "/api/files/1.pdf", query); signature != "90451r6bwQTg1mCxmuZXGXXfQ3orSYtNyirvjUhRHXo" {
+		t.Errorf("unexpected signature %q", signature)
+	}
+}
+
+func TestVerifySignedUrl(t *testing.T) {
+	h := &RequestHandler{
+		SignedUrlsKey:     "key",
+		SignedUrlsRole:    "web_anon",
+		SignedUrlsContext: map[string]string{"source": "signed"},
+	}
+
+	in := time.Now().Add(time.Hour)
+	signed, err := makeSignedUrl([]byte("key"), "GET", "/api/files/1.pdf?download=true", in, map[string]string{"user_id": "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := makeSignedUrl([]byte("key"), "GET", "/api/files/1.pdf", time.Now().Add(-time.Minute), nil)
+	otherKey, _ := makeSignedUrl([]byte("other"), "GET", "/api/files/1.pdf", in, nil)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		change func(url.Values)
+		valid  bool
+	}{
+		{"valid", "GET", signed, nil, true},
+		{"other method", "POST", signed, nil, false},
+		{"other path", "GET", "/api/files/2.pdf?" + mustParseUrl(t, signed).RawQuery, nil, false},
+		{"changed context", "GET", signed, func(q url.Values) { q.Set("context.user_id", "43") }, false},
+		{"added parameter", "GET", signed, func(q url.Values) { q.Set("filter", "x") }, false},
+		{"removed parameter", "GET", signed, func(q url.Values) { q.Del("download") }, false},
+		{"extended expiration", "GET", signed, func(q url.Values) { q.Set("expires", "99999999999") }, false},
+		{"expired", "GET", expired, nil, false},
+		{"other key", "GET", otherKey, nil, false},
+	}
+
+	for _, test := range tests {
+		u := mustParseUrl(t, test.url)
+		query := u.Query()
+		if test.change != nil {
+			test.change(query)
+		}
+
+		identity, err := h.verifySignedUrl(test.method, u.Path, query)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: valid %v expected, got error %v", test.name, test.valid, err)
+			continue
+		}
+
+		if test.valid && (identity.Role != "web_anon" || identity.Context["user_id"] != "42" || identity.Context["source"] != "signed") {
+			t.Errorf("%s: unexpected identity %+v", test.name, identity)
+		}
+	}
+}
+
+func mustParseUrl(t *testing.T, rawUrl string) *url.URL {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"errors"
+	"strconv"
 
 	queryme "github.com/debackerl/queryme/go"
 )
 
-func buildSelectSqlQuery(sql *SqlBuilder, ftsFunction string, argumentsType map[string]ArgumentType, columns string, relation string, filter queryme.Predicate, order []*queryme.SortOrder, limit int64) error {
+func buildSelectSqlQuery(sql *SqlBuilder, ftsFunction string, argumentsType map[string]ArgumentType, columns string, embeddings []*Embedding, relation string, filter queryme.Predicate, order []*queryme.SortOrder, limit int64, offset int64) error {
 	sql.WriteSql("SELECT ")
 	sql.WriteSql(columns)
+	writeEmbeddings(sql, ftsFunction, relation, embeddings)
 	sql.WriteSql(" FROM ")
 	sql.WriteId(relation)
 
@@ -27,9 +29,267 @@ func buildSelectSqlQuery(sql *SqlBuilder, ftsFunction string, argumentsType map[
 		sql.WriteValue(limit)
 	}
 
+	if offset > 0 {
+		sql.WriteSql(" OFFSET ")
+		sql.WriteValue(offset)
+	}
+
 	return nil
 }
 
+// writes subqueries of embedded resources as additional columns, JSON arrays of records or JSON objects
+// the relation of the main query must be named relation
+func writeEmbeddings(sql *SqlBuilder, ftsFunction string, relation string, embeddings []*Embedding) {
+	for _, embedding := range embeddings {
+		embedded := embedding.Route
+
+		sql.WriteSql(",(SELECT ")
+		if embedding.Key.ToMany {
+			sql.WriteSql("coalesce(json_agg(")
+			sql.WriteId(embeddedRelationAlias)
+			sql.WriteSql(" ORDER BY ")
+			sql.WriteId(embeddedRelationAlias)
+			sql.WriteSql(".")
+			sql.WriteId(embedded.CursorColumn)
+			sql.WriteSql("),'[]')")
+		} else {
+			sql.WriteSql("row_to_json(")
+			sql.WriteId(embeddedRelationAlias)
+			sql.WriteSql(")")
+		}
+		sql.WriteSql(" FROM (SELECT ")
+		sql.WriteSql(embedded.SelectedColumns)
+		sql.WriteSql(" FROM ")
+		sql.WriteId(embedded.ObjectName)
+		sql.WriteSql(" AS ")
+		sql.WriteId(embeddedRelationAlias)
+		sql.WriteSql(" WHERE ")
+
+		for i, column := range embedding.Key.Columns {
+			if i > 0 {
+				sql.WriteSql(" AND ")
+			}
+			sql.WriteId(embeddedRelationAlias)
+			sql.WriteSql(".")
+			sql.WriteId(embedding.Key.RemoteColumns[i])
+			sql.WriteSql("=")
+			sql.WriteId(relation)
+			sql.WriteSql(".")
+			sql.WriteId(column)
+		}
+
+		// constants of the embedded route apply as equality conditions, like in its own requests
+		if len(embedded.Constants) > 0 {
+			terms := make([]queryme.Predicate, 0, len(embedded.Constants))
+			for k, v := range embedded.Constants {
+				terms = append(terms, queryme.Eq{Field: queryme.Field(k), Operands: []queryme.Value{v}})
+			}
+			sql.WriteSql(" AND ")
+			PredicateToPostgreSql(sql, ftsFunction, embedded.ParametersTypes, queryme.And(terms))
+		}
+
+		if !embedding.Key.ToMany {
+			sql.WriteSql(" LIMIT 1")
+		} else {
+			sql.WriteSql(" ORDER BY ")
+			sql.WriteId(embeddedRelationAlias)
+			sql.WriteSql(".")
+			sql.WriteId(embedded.CursorColumn)
+
+			// one more record is read to know if the array is truncated
+			if embedded.MaxLimit > 0 {
+				sql.WriteSql(" LIMIT ")
+				sql.WriteValue(embedded.MaxLimit + 1)
+			}
+		}
+
+		sql.WriteSql(") AS ")
+		sql.WriteId(embeddedRelationAlias)
+		sql.WriteSql(") AS ")
+		sql.WriteId(embedding.Alias)
+	}
+}
+
+// groups records of the relation, filters apply before aggregation and sort orders refer to output columns
+func buildAggregateSqlQuery(sql *SqlBuilder, ftsFunction string, argumentsType map[string]ArgumentType, aggregation *Aggregation, relation string, filter queryme.Predicate, order []*queryme.SortOrder, limit int64, offset int64) error {
+	sql.WriteSql("SELECT ")
+
+	i := 0
+	for _, group := range aggregation.Groups {
+		if i > 0 {
+			sql.WriteSql(",")
+		}
+
+		if group.Function != "" {
+			sql.WriteSql("date_trunc('")
+			sql.WriteSql(group.Function)
+			sql.WriteSql("',")
+			sql.WriteId(group.Column)
+			sql.WriteSql(")")
+		} else {
+			sql.WriteId(group.Column)
+		}
+		sql.WriteSql(" AS ")
+		sql.WriteId(group.Alias)
+
+		i++
+	}
+
+	for _, aggregate := range aggregation.Aggregates {
+		if i > 0 {
+			sql.WriteSql(",")
+		}
+
+		switch {
+		case aggregate.Function == "count_distinct":
+			sql.WriteSql("count(DISTINCT ")
+			sql.WriteId(aggregate.Column)
+			sql.WriteSql(")")
+		case aggregate.Column == "":
+			sql.WriteSql("count(*)")
+		default:
+			sql.WriteSql(aggregate.Function)
+			sql.WriteSql("(")
+			sql.WriteId(aggregate.Column)
+			sql.WriteSql(")")
+		}
+		sql.WriteSql(" AS ")
+		sql.WriteId(aggregate.Alias)
+
+		i++
+	}
+
+	sql.WriteSql(" FROM ")
+	sql.WriteId(relation)
+
+	if filter != nil {
+		sql.WriteSql(" WHERE ")
+		PredicateToPostgreSql(sql, ftsFunction, argumentsType, filter)
+	}
+
+	if len(aggregation.Groups) > 0 {
+		sql.WriteSql(" GROUP BY ")
+		for i := range aggregation.Groups {
+			if i > 0 {
+				sql.WriteSql(",")
+			}
+			sql.WriteSql(strconv.Itoa(i + 1))
+		}
+	}
+
+	if len(order) > 0 {
+		sql.WriteSql(" ORDER BY ")
+		SortOrderToPostgreSql(sql, order)
+	}
+
+	if limit > 0 {
+		sql.WriteSql(" LIMIT ")
+		sql.WriteValue(limit)
+	}
+
+	if offset > 0 {
+		sql.WriteSql(" OFFSET ")
+		sql.WriteValue(offset)
+	}
+
+	return nil
+}
+
+// selects records following the cursor of the page, or preceding it for backward cursors, without OFFSET
+// values of the sort order are returned as text array in the last column, named by cursorColumnName
+func buildKeysetSelectSqlQuery(sql *SqlBuilder, ftsFunction string, argumentsType map[string]ArgumentType, declTypes map[string]string, columns string, embeddings []*Embedding, relation string, filter queryme.Predicate, page *Page, limit int64) error {
+	backward := page.Cursor != nil && page.Cursor.Backward
+
+	// records preceding a cursor are read in reverse order, and sorted again by the outer query
+	innerOrder := page.Order
+	if backward {
+		innerOrder = make([]*queryme.SortOrder, len(page.Order))
+		for i, o := range page.Order {
+			innerOrder[i] = &queryme.SortOrder{Field: o.Field, Ascending: !o.Ascending}
+		}
+	}
+
+	// parameters must be numbered in order of appearance, embeddings come first
+	sql.WriteSql("SELECT ")
+	sql.WriteSql(columns)
+	writeEmbeddings(sql, ftsFunction, relation, embeddings)
+	sql.WriteSql(",")
+	sql.WriteId(cursorColumnName)
+	sql.WriteSql(" FROM (SELECT *,ARRAY[")
+	for i, o := range page.Order {
+		if i > 0 {
+			sql.WriteSql(",")
+		}
+		sql.WriteId(string(o.Field))
+		sql.WriteSql("::text")
+	}
+	sql.WriteSql("] AS ")
+	sql.WriteId(cursorColumnName)
+	sql.WriteSql(" FROM ")
+	sql.WriteId(relation)
+
+	if filter != nil || page.Cursor != nil {
+		sql.WriteSql(" WHERE ")
+	}
+
+	if filter != nil {
+		sql.WriteSql("(")
+		PredicateToPostgreSql(sql, ftsFunction, argumentsType, filter)
+		sql.WriteSql(")")
+	}
+
+	if page.Cursor != nil {
+		if filter != nil {
+			sql.WriteSql(" AND ")
+		}
+
+		// (a > $1) OR (a = $1 AND b > $2) OR ..., comparisons depending on direction of each field
+		sql.WriteSql("(")
+		for i, o := range innerOrder {
+			if i > 0 {
+				sql.WriteSql(" OR ")
+			}
+
+			sql.WriteSql("(")
+			for j := 0; j < i; j++ {
+				writeCursorComparison(sql, declTypes, innerOrder[j].Field, "=", page.Cursor.Values[j])
+				sql.WriteSql(" AND ")
+			}
+			if o.Ascending {
+				writeCursorComparison(sql, declTypes, o.Field, ">", page.Cursor.Values[i])
+			} else {
+				writeCursorComparison(sql, declTypes, o.Field, "<", page.Cursor.Values[i])
+			}
+			sql.WriteSql(")")
+		}
+		sql.WriteSql(")")
+	}
+
+	sql.WriteSql(" ORDER BY ")
+	SortOrderToPostgreSql(sql, innerOrder)
+
+	if limit > 0 {
+		sql.WriteSql(" LIMIT ")
+		sql.WriteValue(limit)
+	}
+
+	sql.WriteSql(") AS ")
+	sql.WriteId(relation)
+	sql.WriteSql(" ORDER BY ")
+	SortOrderToPostgreSql(sql, page.Order)
+
+	return nil
+}
+
+// values of cursors are cast from text to the declared type of their column
+func writeCursorComparison(sql *SqlBuilder, declTypes map[string]string, field queryme.Field, operator string, value *string) {
+	sql.WriteId(string(field))
+	sql.WriteSql(operator)
+	sql.WriteValue(value)
+	sql.WriteSql("::text::")
+	sql.WriteSql(declTypes[string(field)])
+}
+
 func buildInsertSqlQuery(sql *SqlBuilder, ftsFunction string, argumentsType map[string]ArgumentType, columns string, relation string, query map[string]interface{}) error {
 	sql.WriteSql("INSERT INTO ")
 	sql.WriteId(relation)
@@ -62,13 +322,14 @@ func buildInsertSqlQuery(sql *SqlBuilder, ftsFunction string, argumentsType map[
 		i++
 	}
 
-	sql.WriteSql(" RETURNING ")
+	sql.WriteSql(") RETURNING ")
 	sql.WriteSql(columns)
 
 	return nil
 }
 
-func buildUpdateSqlQuery(sql *SqlBuilder, ftsFunction string, argumentsType map[string]ArgumentType, relation string, filter queryme.Predicate, query map[string]interface{}) error {
+// records are returned if columns are not empty
+func buildUpdateSqlQuery(sql *SqlBuilder, ftsFunction string, argumentsType map[string]ArgumentType, columns string, relation string, filter queryme.Predicate, query map[string]interface{}) error {
 	sql.WriteSql("UPDATE ")
 	sql.WriteId(relation)
 
@@ -95,6 +356,11 @@ func buildUpdateSqlQuery(sql *SqlBuilder, ftsFunction string, argumentsType map[
 		PredicateToPostgreSql(sql, ftsFunction, argumentsType, filter)
 	}
 
+	if columns != "" {
+		sql.WriteSql(" RETURNING ")
+		sql.WriteSql(columns)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// answers readiness probes, pgasus is ready once routes are loaded, while it listens to notifications and its last reload succeeded
+func (h *RequestHandler) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	reload := h.lastReload()
+	ready := atomic.LoadPointer(&h.handler) != nil && h.listenerState().Connected && reload != nil && reload.Error == ""
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"ready":            ready,
+		"maintenance_mode": h.maintenanceState().Mode,
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+// exposes metrics in Prometheus text format
+func (h *RequestHandler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	mode := h.maintenanceState().Mode
+
+	fmt.Fprintln(w, "# HELP pgasus_maintenance_mode Current maintenance mode, set to 1.")
+	fmt.Fprintln(w, "# TYPE pgasus_maintenance_mode gauge")
+	for _, m := range []string{ModeOnline, ModeReadOnly, ModeOffline} {
+		value := 0
+		if m == mode {
+			value = 1
+		}
+		fmt.Fprintf(w, "pgasus_maintenance_mode{mode=%q} %d\n", m, value)
+	}
+
+	listener := h.listenerState()
+	connected := 0
+	if listener.Connected {
+		connected = 1
+	}
+
+	fmt.Fprintln(w, "# HELP pgasus_listener_connected 1 if the connection listening to notifications is established.")
+	fmt.Fprintln(w, "# TYPE pgasus_listener_connected gauge")
+	fmt.Fprintf(w, "pgasus_listener_connected %d\n", connected)
+	fmt.Fprintln(w, "# HELP pgasus_listener_connections_total Connections established to listen to notifications.")
+	fmt.Fprintln(w, "# TYPE pgasus_listener_connections_total counter")
+	fmt.Fprintf(w, "pgasus_listener_connections_total %d\n", listener.Connections)
+
+	if reload := h.lastReload(); reload != nil {
+		success := 1
+		if reload.Error != "" {
+			success = 0
+		}
+
+		fmt.Fprintln(w, "# HELP pgasus_last_reload_success 1 if the last reload of routes succeeded.")
+		fmt.Fprintln(w, "# TYPE pgasus_last_reload_success gauge")
+		fmt.Fprintf(w, "pgasus_last_reload_success %d\n", success)
+		fmt.Fprintln(w, "# HELP pgasus_last_reload_timestamp_seconds Time of the last reload of routes.")
+		fmt.Fprintln(w, "# TYPE pgasus_last_reload_timestamp_seconds gauge")
+		fmt.Fprintf(w, "pgasus_last_reload_timestamp_seconds %d\n", reload.Time.Unix())
+		fmt.Fprintln(w, "# HELP pgasus_routes_loaded Routes loaded by the last reload.")
+		fmt.Fprintln(w, "# TYPE pgasus_routes_loaded gauge")
+		fmt.Fprintf(w, "pgasus_routes_loaded %d\n", reload.Loaded)
+		fmt.Fprintln(w, "# HELP pgasus_routes_invalid Routes skipped by the last reload.")
+		fmt.Fprintln(w, "# TYPE pgasus_routes_invalid gauge")
+		fmt.Fprintf(w, "pgasus_routes_invalid %d\n", len(reload.RouteErrors))
+	}
+}
+
+// ListenerState describes the connection listening to notifications
+type ListenerState struct {
+	Connected   bool
+	Since       time.Time
+	LastError   string
+	Connections int64
+}
+
+const (
+	listenerMinBackoff = time.Second
+	listenerMaxBackoff = time.Minute
+)
+
+// returns the current state of the listener, disconnected until first connection
+func (h *RequestHandler) listenerState() *ListenerState {
+	if state, ok := h.listener.Load().(*ListenerState); ok {
+		return state
+	}
+
+	return &ListenerState{}
+}
+
+// records a change of the listener's connection, errors are kept until the next one
+func (h *RequestHandler) setListenerState(connected bool, err error) {
+	previous := h.listenerState()
+
+	state := &ListenerState{
+		Connected:   connected,
+		Since:       previous.Since,
+		LastError:   previous.LastError,
+		Connections: previous.Connections,
+	}
+
+	if connected != previous.Connected || state.Since.IsZero() {
+		state.Since = time.Now()
+	}
+	if connected {
+		state.Connections++
+	}
+	if err != nil {
+		state.LastError = err.Error()
+	}
+
+	h.listener.Store(state)
+}
+
+// ReloadResult describes the last reload of routes
+type ReloadResult struct {
+	Time        time.Time `json:"time"`
+	Loaded      int       `json:"loaded"`
+	RouteErrors []string  `json:"route_errors"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// returns the result of the last reload of routes, nil before the first one
+func (h *RequestHandler) lastReload() *ReloadResult {
+	if result, ok := h.reload.Load().(*ReloadResult); ok {
+		return result
+	}
+
+	return nil
+}
+
+func (h *RequestHandler) recordReload(loaded int, routeErrors []*RouteError, err error) {
+	result := &ReloadResult{
+		Time:        time.Now(),
+		Loaded:      loaded,
+		RouteErrors: make([]string, 0, len(routeErrors)),
+	}
+
+	for _, routeError := range routeErrors {
+		result.RouteErrors = append(result.RouteErrors, routeError.Error())
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	h.reload.Store(result)
+}